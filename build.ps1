@@ -1,6 +1,11 @@
+$version = git describe --tags --always --dirty
+$commit = git rev-parse --short HEAD
+$date = (Get-Date).ToUniversalTime().ToString('yyyy-MM-ddTHH:mm:ssZ')
+$ldflags = "-X main.version=$version -X main.commit=$commit -X main.date=$date"
+
 $env:GOOS='windows'
 $env:GOARCH='386'
-go build -o udpproxy_386.exe main.go
+go build -ldflags $ldflags -o udpproxy_386.exe .
 
 $env:GOARCH='amd64'
-go build -o udpproxy_amd64.exe main.go
\ No newline at end of file
+go build -ldflags $ldflags -o udpproxy_amd64.exe .
\ No newline at end of file
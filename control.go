@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/annlumia/udp-proxy/proxy"
+)
+
+// Address -control-addr listens on: a bare port, or a host:port with no
+// host, binds to localhost only
+func controlAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return net.JoinHostPort("127.0.0.1", addr)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Pause after the first failed accept on the control socket, doubled after
+// each further failure in a row up to maxControlBackoff
+const (
+	controlBackoff    = 5 * time.Millisecond
+	maxControlBackoff = time.Second
+)
+
+// Serve control commands over TCP on addr, for hosts where the HTTP admin
+// API cannot be exposed. Only started when -control-addr is set.
+func (p *program) serveControl(addr, token string) {
+	l, err := net.Listen("tcp", controlAddr(addr))
+	if err != nil {
+		p.proxy.Vlogf(proxy.LevelError, "Error: %s\n", err.Error())
+		return
+	}
+	p.proxy.Vlogf(proxy.LevelInfo, "Serving control commands on %s\n", l.Addr().String())
+	backoff := time.Duration(0)
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Such as running out of descriptors, which may pass
+			if backoff *= 2; backoff == 0 {
+				backoff = controlBackoff
+			} else if backoff > maxControlBackoff {
+				backoff = maxControlBackoff
+			}
+			p.proxy.Vlogf(proxy.LevelError, "Error: %s, retrying in %s\n", err.Error(), backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		go p.runControl(c, token)
+	}
+}
+
+// Failed auth commands after which a control client is disconnected
+const maxAuthFailures = 3
+
+// Read commands from c a line at a time, answering each with one or more
+// lines of text, until the client quits or hangs up. With a token set,
+// nothing but auth is accepted until the client has sent it, and a client
+// sending maxAuthFailures wrong tokens in a row is hung up on.
+func (p *program) runControl(c net.Conn, token string) {
+	defer c.Close()
+	authorized := token == ""
+	failures := 0
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		switch {
+		case args[0] == "quit":
+			return
+		case args[0] == "auth" && token == "":
+			// Nothing to check, and a stray auth must not lock the client out
+			fmt.Fprintln(c, "ok")
+		case args[0] == "auth":
+			authorized = len(args) == 2 && subtle.ConstantTimeCompare([]byte(args[1]), []byte(token)) == 1
+			if authorized {
+				failures = 0
+				fmt.Fprintln(c, "ok")
+				continue
+			}
+			if failures++; failures >= maxAuthFailures {
+				fmt.Fprintln(c, "error: bad token, closing")
+				return
+			}
+			fmt.Fprintln(c, "error: bad token")
+		case !authorized:
+			fmt.Fprintln(c, "error: unauthorized, send auth <token> first")
+		default:
+			p.controlCommand(c, args)
+		}
+	}
+}
+
+// Carry out one control command on every proxy and write the reply to c
+func (p *program) controlCommand(c net.Conn, args []string) {
+	switch {
+	case args[0] == "help":
+		fmt.Fprintln(c, "commands: verbosity <spec>, drop <rate>, stats, connections, auth <token>, quit")
+	case args[0] == "verbosity" && len(args) == 2:
+		level, areas, err := proxy.ParseVerbosity(args[1], proxy.LevelError)
+		if err != nil {
+			fmt.Fprintf(c, "error: %s\n", err.Error())
+			return
+		}
+		for _, px := range p.proxies {
+			px.SetVerbosity(level, areas)
+		}
+		fmt.Fprintln(c, "ok")
+	case args[0] == "drop" && len(args) == 2:
+		rate, err := strconv.ParseFloat(args[1], 64)
+		for i := 0; err == nil && i < len(p.proxies); i++ {
+			err = p.proxies[i].SetDropRate(rate)
+		}
+		if err != nil {
+			fmt.Fprintf(c, "error: %s\n", err.Error())
+			return
+		}
+		fmt.Fprintln(c, "ok")
+	case args[0] == "stats" && len(args) == 1:
+		var t proxy.Stats
+		conns := 0
+		for _, px := range p.proxies {
+			pt := px.Totals()
+			t.C2SPackets += pt.C2SPackets
+			t.C2SBytes += pt.C2SBytes
+			t.S2CPackets += pt.S2CPackets
+			t.S2CBytes += pt.S2CBytes
+			conns += len(px.Connections())
+		}
+		fmt.Fprintf(c, "connections %d; client to server %d packets %d bytes; server to client %d packets %d bytes\n",
+			conns, t.C2SPackets, t.C2SBytes, t.S2CPackets, t.S2CBytes)
+	case args[0] == "connections" && len(args) == 1:
+		writeConnections(c, p.connections())
+	default:
+		fmt.Fprintf(c, "error: unknown command %q, try help\n", strings.Join(args, " "))
+	}
+}
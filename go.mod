@@ -2,4 +2,13 @@ module github.com/annlumia/udp-proxy
 
 go 1.16
 
-require github.com/kardianos/service v1.2.0
+require (
+	github.com/google/gopacket v1.1.19
+	github.com/kardianos/service v1.2.0
+	github.com/pierrec/lz4/v4 v4.1.18
+	github.com/prometheus/client_golang v1.11.1
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.13.0
+	golang.org/x/time v0.3.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/annlumia/udp-proxy/proxy"
+)
+
+// Proxy logger sending errors and warnings to one destination and every
+// other line to another
+type splitLogger struct {
+	data   *log.Logger
+	errors *log.Logger
+}
+
+func (l splitLogger) Printf(format string, v ...interface{}) {
+	l.data.Printf(format, v...)
+}
+
+func (l splitLogger) Logf(level int, format string, v ...interface{}) {
+	if level <= proxy.LevelError {
+		l.errors.Printf(format, v...)
+		return
+	}
+	l.data.Printf(format, v...)
+}
+
+// Open the destinations named by -log-file and -error-log-file. Returns a
+// nil Logger when neither is set, leaving both streams combined.
+func openLogs(format string) (proxy.Logger, error) {
+	if *ilogfile == "" && *ierrlog == "" {
+		return nil, nil
+	}
+	errors, err := openLog(*ierrlog, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	data, err := openLog(*ilogfile, errors)
+	if err != nil {
+		return nil, err
+	}
+	// JSON records carry their own time
+	flags := log.LstdFlags
+	if format == "json" {
+		flags = 0
+	}
+	return splitLogger{data: log.New(data, "", flags), errors: log.New(errors, "", flags)}, nil
+}
+
+// Open the log file at path for appending, "-" for stdout and empty for def
+func openLog(path string, def io.Writer) (io.Writer, error) {
+	switch path {
+	case "":
+		return def, nil
+	case "-":
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
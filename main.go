@@ -3,205 +3,760 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/annlumia/udp-proxy/proxy"
 	"github.com/kardianos/service"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v3"
 )
 
 var logger service.Logger
 
-// Information maintained for each client/server connection
-type Connection struct {
-	ClientAddr *net.UDPAddr // Address of the client
-	ServerConn *net.UDPConn // UDP connection to server
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = "dev"
+	date    = "dev"
+)
+
+// --------------------------------------------------------------------------
+// Service
+// --------------------------------------------------------------------------
+type program struct {
+	DisplayName string
+	proxy       *proxy.Proxy   // First of proxies, which logs for the program
+	proxies     []*proxy.Proxy // One per -map, or just proxy
+	service     service.Service
 }
 
-// Generate a new connection by opening a UDP connection to the server
-func NewConnection(srvAddr, cliAddr *net.UDPAddr) *Connection {
-	conn := new(Connection)
-	conn.ClientAddr = cliAddr
-	srvudp, err := net.DialUDP("udp", nil, srvAddr)
-	if checkreport(1, err) {
-		return nil
+func (p *program) Start(s service.Service) error {
+	if !*iquiet {
+		logger.Info("Starting ", p.DisplayName, " ", version)
+	}
+	if *imetrics != "" {
+		go p.serveMetrics(*imetrics)
+	}
+	if *ihealth != "" {
+		go p.serveHealth(*ihealth)
+	}
+	if *iadmin != "" {
+		go p.serveAdmin(*iadmin, *itoken)
+	}
+	if *icontrol != "" {
+		go p.serveControl(*icontrol, *ictoken)
+	}
+	if *iconfig != "" {
+		go p.reloadOnHangup()
+	}
+	go p.dumpOnSignal()
+	go p.drainOnSignal()
+	for i, px := range p.proxies {
+		if err := px.Start(context.Background()); err != nil {
+			for _, started := range p.proxies[:i] {
+				started.Close()
+			}
+			return err
+		}
 	}
-	conn.ServerConn = srvudp
-	return conn
+	return nil
 }
 
-// Global state
-// Connection used by clients as the proxy server
-var ProxyConn *net.UDPConn
+// Report whether every proxy is healthy
+func (p *program) healthy() bool {
+	for _, px := range p.proxies {
+		if !px.Healthy() {
+			return false
+		}
+	}
+	return true
+}
 
-// Address of server
-var ServerAddr *net.UDPAddr
+// Report whether every proxy is ready
+func (p *program) ready() bool {
+	for _, px := range p.proxies {
+		if !px.Ready() {
+			return false
+		}
+	}
+	return true
+}
 
-// Mapping from client addresses (as host:port) to connection
-var ClientDict map[string]*Connection = make(map[string]*Connection)
+// Start or stop draining every proxy
+func (p *program) setDraining(on bool) {
+	for _, px := range p.proxies {
+		px.SetDraining(on)
+	}
+}
 
-// Mutex used to serialize access to the dictionary
-var dmutex *sync.Mutex = new(sync.Mutex)
+// Live connections of all proxies
+func (p *program) connections() []proxy.ConnectionInfo {
+	var list []proxy.ConnectionInfo
+	for _, px := range p.proxies {
+		list = append(list, px.Connections()...)
+	}
+	return list
+}
 
-func setup(hostport string, port int) bool {
-	// Set up Proxy
-	saddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
-	if checkreport(1, err) {
-		return false
+// Close the connection for client on every proxy that has one
+func (p *program) closeConnection(client string) bool {
+	found := false
+	for _, px := range p.proxies {
+		if px.CloseConnection(client) {
+			found = true
+		}
 	}
-	pudp, err := net.ListenUDP("udp", saddr)
-	if checkreport(1, err) {
-		return false
+	return found
+}
+
+// Re-read the configuration file each time SIGHUP arrives
+func (p *program) reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		p.proxy.Vlogf(proxy.LevelInfo, "Received SIGHUP, reloading %s\n", *iconfig)
+		p.reload()
 	}
-	ProxyConn = pudp
-	Vlogf(2, "Proxy serving on port %d\n", port)
+}
 
-	// Get server address
-	srvaddr, err := net.ResolveUDPAddr("udp", hostport)
-	if checkreport(1, err) {
-		return false
+// Re-read the configuration file and apply it to every proxy
+func (p *program) reload() error {
+	configs, err := loadConfigs()
+	if err == nil && len(configs) != len(p.proxies) {
+		p.proxy.Vlogf(proxy.LevelError, "Warning: map change from %d to %d ports requires a restart\n",
+			len(p.proxies), len(configs))
 	}
-	ServerAddr = srvaddr
-	Vlogf(2, "Connected to server at %s\n", hostport)
-	return true
+	for i := 0; err == nil && i < len(configs) && i < len(p.proxies); i++ {
+		err = p.proxies[i].Reload(configs[i])
+	}
+	if err != nil {
+		p.proxy.Vlogf(proxy.LevelError, "Error: reload failed: %s\n", err.Error())
+	}
+	return err
 }
 
-func dlock() {
-	dmutex.Lock()
+// Write a table of the live connections to -dump-file, or to stderr
+func (p *program) dumpConnections() {
+	out := os.Stderr
+	if *idump != "" {
+		f, err := os.Create(*idump)
+		if err != nil {
+			p.proxy.Vlogf(proxy.LevelError, "Error: %s\n", err.Error())
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	list := p.connections()
+	writeConnections(out, list)
+	p.proxy.Vlogf(proxy.LevelInfo, "Dumped %d connections\n", len(list))
 }
 
-func dunlock() {
-	dmutex.Unlock()
+// Write list to out as a table
+func writeConnections(out io.Writer, list []proxy.ConnectionInfo) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tCLIENT\tSERVER\tC2S PACKETS\tC2S BYTES\tS2C PACKETS\tS2C BYTES\tAGE\n")
+	for _, c := range list {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%d\t%.3fs\n", c.ID, c.Client, c.Server,
+			c.C2SPackets, c.C2SBytes, c.S2CPackets, c.S2CBytes, c.Age)
+	}
+	w.Flush()
 }
 
-// Go routine which manages connection from server to single client
-func RunConnection(conn *Connection) {
-	var buffer [1500]byte
-	for {
-		// Read from server
-		n, err := conn.ServerConn.Read(buffer[0:])
-		if checkreport(1, err) {
-			continue
-		}
-		// Relay it to client
-		_, err = ProxyConn.WriteToUDP(buffer[0:n], conn.ClientAddr)
-		if checkreport(1, err) {
-			continue
+func (p *program) Stop(s service.Service) error {
+	if !*iquiet {
+		logger.Info("Stopping ", p.DisplayName)
+	}
+	var err error
+	for _, px := range p.proxies {
+		if cerr := px.Close(); err == nil {
+			err = cerr
 		}
-		Vlogf(3, "Relayed '%s' from server to %s.\n",
-			string(buffer[0:n]), conn.ClientAddr.String())
+	}
+	if service.Interactive() {
+		os.Exit(0)
+	}
+	return err
+}
+
+// Serve /metrics on addr. Only started when -metrics-addr is set.
+func (p *program) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	p.proxy.Vlogf(proxy.LevelInfo, "Serving metrics on %s\n", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		p.proxy.Vlogf(proxy.LevelError, "Error: %s", err.Error())
 	}
 }
 
-// Routine to handle inputs to Proxy port
-func RunProxy() {
-	var buffer [1500]byte
-	for {
-		n, cliaddr, err := ProxyConn.ReadFromUDP(buffer[0:])
-		if checkreport(1, err) {
-			continue
-		}
-		Vlogf(3, "Read '%s' from client %s\n",
-			string(buffer[0:n]), cliaddr.String())
-		saddr := cliaddr.String()
-		dlock()
-		conn, found := ClientDict[saddr]
-		if !found {
-			conn = NewConnection(ServerAddr, cliaddr)
-			if conn == nil {
-				dunlock()
-				continue
+// Serve /healthz and /readyz on addr for load balancer checks. Only
+// started when -health-addr is set.
+func (p *program) serveHealth(addr string) {
+	check := func(ok func() bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !ok() {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
 			}
-			ClientDict[saddr] = conn
-			dunlock()
-			Vlogf(2, "Created new connection for client %s\n", saddr)
-			// Fire up routine to manage new connection
-			go RunConnection(conn)
-		} else {
-			Vlogf(5, "Found connection for client %s\n", saddr)
-			dunlock()
+			fmt.Fprintln(w, "ok")
 		}
-		// Relay to server
-		_, err = conn.ServerConn.Write(buffer[0:n])
-		if checkreport(1, err) {
-			continue
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", check(p.healthy))
+	mux.Handle("/readyz", check(p.ready))
+	p.proxy.Vlogf(proxy.LevelInfo, "Serving health checks on %s\n", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		p.proxy.Vlogf(proxy.LevelError, "Error: %s", err.Error())
+	}
+}
+
+// Serve the admin API on addr: GET /connections lists the live connections
+// and DELETE /connections/{client} closes those of a client, while PUT /drain starts
+// draining and DELETE /drain stops it. POST /reload re-reads -config like
+// SIGHUP. With a token set, requests must carry it as a bearer token. Only
+// started when -admin-addr is set.
+func (p *program) serveAdmin(addr, token string) {
+	authorized := func(r *http.Request) bool {
+		if token == "" {
+			return true
 		}
+		got := []byte(r.Header.Get("Authorization"))
+		return subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) == 1
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		list := p.connections()
+		if list == nil {
+			list = []proxy.ConnectionInfo{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	})
+	mux.HandleFunc("/connections/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !p.closeConnection(strings.TrimPrefix(r.URL.Path, "/connections/")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if *iconfig == "" {
+			http.Error(w, "no -config file to reload", http.StatusConflict)
+			return
+		}
+		p.proxy.Vlogf(proxy.LevelInfo, "Reloading %s by admin request\n", *iconfig)
+		if err := p.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]bool{"draining": p.proxy.Draining()})
+			return
+		case http.MethodPut:
+			p.setDraining(true)
+		case http.MethodDelete:
+			p.setDraining(false)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	p.proxy.Vlogf(proxy.LevelInfo, "Serving admin API on %s\n", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		p.proxy.Vlogf(proxy.LevelError, "Error: %s", err.Error())
 	}
 }
 
-var verbosity int = 6
+var (
+	ihelp    = flag.Bool("h", false, "Show help information")
+	iversion = flag.Bool("version", false, "Show version information")
+	iconfig  = flag.String("config", "", "Load settings from a YAML or JSON file; flags given on the command line override it")
+	icheck   = flag.Bool("check-config", false, "Validate the settings from flags and -config, print them with defaults filled in as YAML and exit, 0 if valid and 78 if not")
+	ipport   = flag.Int("p", 8800, "Proxy port")
+	ilisten  = flag.String("listen", "", "Listen on this host:port only (overrides -p; default all addresses)")
+	isport   = flag.Int("P", 8000, "Server port")
+	ishost   = flag.String("H", "192.168.32.195", "Server address")
+	iservers = flag.String("servers", "", "Comma-separated server list host:port,host:port, each optionally weighted as host:port=weight (overrides -H and -P)")
+	ibalance = flag.String("balance", "roundrobin", "How new clients are spread over -servers: roundrobin by weight, or consistent, hashing each client IP so it keeps its server across restarts")
+	imap     = mapVar("map", "Listen on a port and relay it to its own server, as port:host:port; repeat for more ports (overrides -p, -H, -P and -servers)")
+	iverb    = levelVar("v", proxy.LevelError, "Verbosity: 0 quiet, 1 error, 2 info, 3 debug (every datagram), 4 verbose (drops), 5 trace, 6 all; by number or name, then optionally area=level for the proxy, conn and errors areas, e.g. 2,conn=5")
+	iquiet   = flag.Bool("quiet", false, "Log only errors and warnings, without the startup and shutdown lines (overrides -v)")
+	ilogfmt  = flag.String("log-format", "text", "Log format: text or json")
+	ilogfile = flag.String("log-file", "", "Append log lines other than errors and warnings to this file, - for stdout (default with the errors)")
+	ierrlog  = flag.String("error-log-file", "", "Append errors and warnings to this file, - for stdout (default stderr)")
+	ihexdump = flag.Bool("hexdump", false, "Log payload sizes instead of raw payloads, with hex dumps at verbosity 5 and up")
+	ihexlen  = flag.Int("hexdump-bytes", 64, "Payload bytes included in each hex dump")
+	icrc     = flag.Bool("checksum", false, "Log the CRC32 of each datagram before and after any transform at verbosity 5 and up")
+	ipcap    = flag.String("pcap", "", "Write relayed datagrams in both directions to this pcap file")
+	irtt     = flag.Bool("rtt-probe", false, "Estimate round trips as the time from a datagram to a server to the next one back, exported as udpproxy_rtt_seconds; coarse, for request/response protocols only")
+	istate   = flag.String("state-file", "", "Save which server each client uses here on shutdown, and keep clients on them after a restart")
+	itcp     = flag.String("listen-tcp", "", "Also accept TCP clients on this address, framing each datagram with a 2-byte big-endian length")
+	idscpsrv = flag.Int("dscp-server", 0, "DSCP codepoint (0-63) to mark datagrams sent to servers with")
+	idscpcli = flag.Int("dscp-client", 0, "DSCP codepoint (0-63) to mark datagrams sent to clients with")
+	ittlsrv  = flag.Int("ttl-server", 0, "IP TTL or hop limit (1-255) of datagrams sent to servers (0 keeps the system default)")
+	imcif    = flag.String("mcast-iface", "", "Interface to send to and join multicast group servers on (default chosen by the system)")
+	imcttl   = flag.Int("mcast-ttl", 0, "IP TTL or hop limit (1-255) of datagrams sent to multicast group servers (0 keeps the system default of 1)")
+	ittlcli  = flag.Int("ttl-client", 0, "IP TTL or hop limit (1-255) of datagrams sent to clients (0 keeps the system default)")
+	idfsrv   = flag.Bool("df-server", false, "Set Don't Fragment on datagrams sent to servers, logging the path MTU when one is too large (Linux only)")
+	idfcli   = flag.Bool("df-client", false, "Set Don't Fragment on datagrams sent to clients, logging when one is too large for the path (Linux only)")
+	icomp    = flag.String("compress", "", "Compress datagrams to servers, and decompress their replies, with lz4, for a proxy at the far end run with -compress-client (default off)")
+	icompcli = flag.String("compress-client", "", "Decompress datagrams from clients, and compress replies, with lz4, for a client that is a proxy run with -compress (default off)")
+	ipsk     = flag.String("psk", "", "Hex encoded 32 byte AES-256-GCM key sealing datagrams between clients and proxy; there is no replay protection, so a captured datagram is accepted again if resent")
+	imirror  = flag.String("mirror", "", "Also copy every client datagram to this host:port, discarding its replies")
+	iecho    = flag.Bool("echo", false, "Reflect datagrams back to their clients instead of relaying them, for testing without a server")
+	isingle  = flag.Bool("single-upstream-socket", false, "Talk to the servers over one socket for all clients, matching replies to requests in order")
+	icollaps = flag.String("collapse", "", "Send for every client from this one local host:port over a single upstream socket, so servers see a single peer")
+	isrcip   = flag.String("source-ip", "", "Local IP to send to servers from, pinning egress to one address (default chosen by the system)")
+	iports   = flag.String("local-port-range", "", "Local ports to send to servers from as lo-hi, for firewalls that only pass those (default chosen by the system)")
+	ippv2    = flag.Bool("proxy-protocol", false, "Prepend a PROXY protocol v2 header with the client address to each connection's first datagram")
+	ikeyip   = flag.Bool("key-by-ip", false, "Key clients by IP alone, replying to the port each last sent from, for clients whose port changes; clients behind one NAT then share a connection")
+	ipktinfo = flag.Bool("pktinfo", false, "Key clients by the local address they sent to as well, so one client reaching several addresses of a multi-homed host gets a connection through each")
+	iunix    = flag.String("listen-unix", "", "Serve clients on this unix datagram socket instead of UDP (clients must bind their own socket to get replies)")
+	isrvunix = flag.String("server-unix", "", "Relay to the server on this unix datagram socket instead of over UDP")
+	ibatch   = flag.Int("batch", 0, "Read up to this many datagrams per system call on each proxy socket (Linux only; 0 reads one at a time)")
+	iworkers = flag.Int("workers", 1, "Proxy sockets sharing the port via SO_REUSEPORT, each with its own reader (Linux only)")
+	iconnmod = flag.String("conn-model", "goroutine", "How server sockets are read: goroutine, one routine per connection, or pool, a fixed set of routines over epoll that scales to more idle clients but lets a slow client hold up others (Linux only)")
+	iconnwk  = flag.Int("conn-workers", 0, "Routines reading server sockets with -conn-model pool (0 for GOMAXPROCS)")
+	inet     = flag.String("net", "udp", "Network stack: udp (dual-stack), udp4 or udp6")
+	ibufsize = flag.Int("buffer-size", 1500, "Datagram read buffer size in bytes (1-65507)")
+	imaxpkt  = flag.Int("max-packet", 0, "Drop client datagrams larger than this many bytes (0 for no limit)")
+	irbuf    = flag.Int("read-buffer", 0, "Kernel receive buffer for each socket in bytes (0 keeps the system default)")
+	iwbuf    = flag.Int("write-buffer", 0, "Kernel send buffer for each socket in bytes (0 keeps the system default)")
+	idrop    = flag.Float64("d", 0.0, "Packet drop rate (0.0-1.0)")
+	idup     = flag.Float64("dup-rate", 0.0, "Rate at which relayed packets are sent twice, in each direction apart (0.0-1.0)")
+	idelay   = flag.Duration("delay", 0, "Hold each relayed datagram this long in both directions, emulating latency (0 disables)")
+	ijitter  = flag.Duration("jitter", 0, "Hold each relayed datagram up to this much longer, chosen at random")
+	ireorder = flag.Bool("reorder", false, "Let datagrams with less jitter overtake earlier ones instead of keeping their order")
+	iseed    = flag.Int64("seed", 0, "Random seed for packet drops (0 uses current time)")
+	iidle    = flag.Duration("idle-timeout", 0, "Close connections idle for this long (0 disables)")
+	ilife    = flag.Duration("max-lifetime", 0, "Close connections open for this long even if busy, so clients reconnect and rebalance (0 disables)")
+	ipktmax  = flag.Int64("max-packets", 0, "Close a connection once this many datagrams have been relayed in each direction, e.g. 1 for a request and its response (0 disables)")
+	idrain   = flag.Duration("shutdown-timeout", 5*time.Second, "Maximum time to wait for connections to drain on stop")
+	iresolve = flag.Duration("resolve-interval", 0, "Resolve server hostnames again this often so new connections follow DNS changes (0 disables)")
+	iprobeiv = flag.Duration("health-probe-interval", 0, "Probe every server this often, sending new clients only to those that pass (0 disables)")
+	iprobe   = flag.String("health-probe", "", "Probe payload a healthy server replies to (empty sends an empty datagram and only fails on a refusal)")
+	iprobeto = flag.Duration("health-probe-timeout", time.Second, "Wait this long for a reply to a health probe")
+	irequp   = flag.String("require-upstream", "", "Exit unless every server replies to the health probe (udp) or accepts a TCP connection on its port (tcp) before startup")
+	irequpw  = flag.Duration("require-upstream-wait", 5*time.Second, "Give up on -require-upstream after this long")
+	istats   = flag.Duration("stats-interval", 0, "Log traffic totals this often at verbosity 2 and up (0 disables)")
+	iwrite   = flag.Duration("write-timeout", 0, "Drop a datagram whose write blocks for this long (0 disables)")
+	idialto  = flag.Duration("dial-timeout", 5*time.Second, "Give up opening a server socket after this long")
+	icool    = flag.Duration("dial-cooldown", time.Second, "Refuse new clients for a server this long after dialing it fails (0 disables)")
+	iredial  = flag.Int("redial-attempts", 3, "Times to redial a failed server socket before dropping the connection")
+	ibackoff = flag.Duration("redial-backoff", 100*time.Millisecond, "Wait before the first redial, doubled after each failure")
+	ifailovr = flag.Int("failover-after", 0, "Move a connection to another server after this many datagrams in a row are refused (0 closes it instead)")
+	iunreach = flag.String("unreachable-reply", "", "Payload sent to a client when its server is unreachable (empty sends nothing)")
+	ikeepal  = flag.Duration("upstream-keepalive", 0, "Send -keepalive-payload to a connection's server after this long without client traffic, keeping NAT mappings on the way open (0 disables)")
+	ikapay   = flag.String("keepalive-payload", "", "Payload of upstream keepalives (empty sends a zero-length datagram)")
+	iprefix  = flag.String("require-prefix", "", "Hex bytes a new client's first datagram or TCP frame must start with before a connection is made for it")
+	iminfst  = flag.Int("min-first-packet", 0, "Bytes a new client's first datagram or TCP frame must have before a connection is made for it")
+	imaxconn = flag.Int("max-connections", 0, "Maximum client connections open at once (0 for no limit)")
+	imaxsub  = flag.Int("max-per-subnet", 0, "Maximum client connections open at once from one subnet (0 for no limit)")
+	isubnet  = flag.Int("subnet-prefix", 24, "Prefix length grouping IPv4 clients into subnets for -max-per-subnet")
+	isubnet6 = flag.Int("subnet-prefix6", 64, "Prefix length grouping IPv6 clients into subnets for -max-per-subnet")
+	irate    = flag.Float64("rate", 0, "Per-client packet rate limit in packets/sec (0 disables)")
+	iburst   = flag.Int("burst", 0, "Per-client packet burst size (0 uses the rate rounded up)")
+	ibwsrv   = flag.Float64("bw-server", 0, "Per-connection bandwidth towards the server in bytes/sec, delaying datagrams over it (0 for no limit)")
+	ibwcli   = flag.Float64("bw-client", 0, "Per-connection bandwidth towards the client in bytes/sec, delaying datagrams over it (0 for no limit)")
+	iallow   = flag.String("allow", "", "Comma-separated client CIDRs allowed to use the proxy (default all)")
+	ideny    = flag.String("deny", "", "Comma-separated client CIDRs refused by the proxy")
+	ienforce = flag.Bool("enforce-acl", false, "Close existing connections of clients that reloaded -allow and -deny lists refuse")
+	imetrics = flag.String("metrics-addr", "", "Serve Prometheus metrics on this address (e.g. :9100)")
+	ihealth  = flag.String("health-addr", "", "Serve /healthz and /readyz on this address (e.g. :8081)")
+	iadmin   = flag.String("admin-addr", "", "Serve the admin API for listing and closing connections on this address (e.g. 127.0.0.1:8082)")
+	itoken   = flag.String("admin-token", "", "Bearer token required by the admin API (empty allows any request)")
+	icontrol = flag.String("control-addr", "", "Serve line-based control commands (verbosity, drop, stats, connections) over TCP on this host:port, or port on localhost")
+	ictoken  = flag.String("control-token", "", "Token a control client must send with auth before any other command (empty allows any client)")
+	idrainst = flag.Bool("drain", false, "Start draining: serve existing clients only, toggled by SIGUSR2 or the admin API")
+	idump    = flag.String("dump-file", "", "File the connection table is written to on SIGUSR1 (default stderr)")
+	svcFlag  = flag.String("service", "", "Control the system service.")
+)
 
-// Log result if verbosity level high enough
-func Vlogf(level int, format string, v ...interface{}) {
-	if level <= verbosity {
-		log.Printf(format, v...)
+// Verbosity flag taking a number or a level name, optionally followed by
+// area=level items
+type levelFlag struct {
+	level int
+	areas map[string]int
+}
+
+func (l *levelFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	s := strconv.Itoa(l.level)
+	names := make([]string, 0, len(l.areas))
+	for name := range l.areas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s += fmt.Sprintf(",%s=%d", name, l.areas[name])
 	}
+	return s
 }
 
-// Handle errors
-func checkreport(level int, err error) bool {
-	if err == nil {
-		return false
+func (l *levelFlag) Set(s string) error {
+	level, areas, err := proxy.ParseVerbosity(s, l.level)
+	if err != nil {
+		return err
 	}
-	Vlogf(level, "Error: %s", err.Error())
-	return true
+	l.level, l.areas = level, areas
+	return nil
 }
 
-// --------------------------------------------------------------------------
-// Service
-// --------------------------------------------------------------------------
-type program struct {
-	DisplayName string
-	exit        chan struct{}
-	service     service.Service
+// Define a verbosity flag with the given default
+func levelVar(name string, value int, usage string) *levelFlag {
+	l := &levelFlag{level: value}
+	flag.Var(l, name, usage)
+	return l
 }
 
-func (p *program) Start(s service.Service) error {
-	go p.run()
-	return nil
+// Split a comma-separated flag value, trimming spaces and dropping empties
+func splitList(s string) []string {
+	var list []string
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			list = append(list, field)
+		}
+	}
+	return list
 }
 
-func (p *program) run() {
-	logger.Info("Starting ", p.DisplayName)
-	defer func() {
-		if service.Interactive() {
-			p.Stop(p.service)
-		} else {
-			p.service.Stop()
+// Copy flag values into config. With all set every flag is copied, defaults
+// included; otherwise only the flags given on the command line are, so they
+// override values loaded from a configuration file.
+func applyFlags(config *proxy.Config, all bool) {
+	visit := flag.Visit
+	if all {
+		visit = flag.VisitAll
+	}
+	visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			config.Port = *ipport
+		case "listen":
+			config.Listen = *ilisten
+		case "H", "P":
+			if *iservers == "" {
+				config.Servers = []string{net.JoinHostPort(*ishost, fmt.Sprint(*isport))}
+			}
+		case "servers":
+			if *iservers != "" {
+				config.Servers = splitList(*iservers)
+			}
+		case "balance":
+			config.Balance = *ibalance
+		case "v":
+			config.Verbosity = iverb.level
+			if iverb.areas != nil {
+				config.AreaVerbosity = iverb.areas
+			}
+		case "log-format":
+			config.LogFormat = *ilogfmt
+		case "hexdump":
+			config.HexDump = *ihexdump
+		case "hexdump-bytes":
+			config.HexDumpBytes = *ihexlen
+		case "checksum":
+			config.Checksum = *icrc
+		case "pcap":
+			config.Pcap = *ipcap
+		case "rtt-probe":
+			config.RTTProbe = *irtt
+		case "state-file":
+			config.StateFile = *istate
+		case "listen-tcp":
+			config.ListenTCP = *itcp
+		case "dscp-server":
+			config.DSCPServer = *idscpsrv
+		case "dscp-client":
+			config.DSCPClient = *idscpcli
+		case "ttl-server":
+			config.TTLServer = *ittlsrv
+		case "mcast-iface":
+			config.McastIface = *imcif
+		case "mcast-ttl":
+			config.McastTTL = *imcttl
+		case "ttl-client":
+			config.TTLClient = *ittlcli
+		case "df-server":
+			config.DFServer = *idfsrv
+		case "df-client":
+			config.DFClient = *idfcli
+		case "compress":
+			config.Compress = *icomp
+		case "compress-client":
+			config.CompressClient = *icompcli
+		case "psk":
+			config.PSK = *ipsk
+		case "mirror":
+			config.Mirror = *imirror
+		case "echo":
+			config.Echo = *iecho
+		case "single-upstream-socket":
+			config.SingleUpstreamSocket = *isingle
+		case "collapse":
+			config.Collapse = *icollaps
+		case "source-ip":
+			config.SourceIP = *isrcip
+		case "local-port-range":
+			config.LocalPortRange = *iports
+		case "proxy-protocol":
+			config.ProxyProtocol = *ippv2
+		case "key-by-ip":
+			config.KeyByIP = *ikeyip
+		case "pktinfo":
+			config.PacketInfo = *ipktinfo
+		case "listen-unix":
+			config.ListenUnix = *iunix
+		case "server-unix":
+			config.ServerUnix = *isrvunix
+		case "batch":
+			config.Batch = *ibatch
+		case "workers":
+			config.Workers = *iworkers
+		case "conn-model":
+			config.ConnModel = *iconnmod
+		case "conn-workers":
+			config.ConnWorkers = *iconnwk
+		case "net":
+			config.Network = *inet
+		case "buffer-size":
+			config.BufferSize = *ibufsize
+		case "max-packet":
+			config.MaxPacket = *imaxpkt
+		case "read-buffer":
+			config.ReadBuffer = *irbuf
+		case "write-buffer":
+			config.WriteBuffer = *iwbuf
+		case "d":
+			config.DropRate = *idrop
+		case "dup-rate":
+			config.DupRate = *idup
+		case "delay":
+			config.Delay = *idelay
+		case "jitter":
+			config.Jitter = *ijitter
+		case "reorder":
+			config.Reorder = *ireorder
+		case "seed":
+			config.Seed = *iseed
+		case "idle-timeout":
+			config.IdleTimeout = *iidle
+		case "max-lifetime":
+			config.MaxLifetime = *ilife
+		case "max-packets":
+			config.MaxPackets = *ipktmax
+		case "shutdown-timeout":
+			config.ShutdownTimeout = *idrain
+		case "resolve-interval":
+			config.ResolveInterval = *iresolve
+		case "health-probe-interval":
+			config.HealthProbeInterval = *iprobeiv
+		case "health-probe":
+			config.HealthProbe = *iprobe
+		case "health-probe-timeout":
+			config.HealthProbeTimeout = *iprobeto
+		case "require-upstream":
+			config.RequireUpstream = *irequp
+		case "require-upstream-wait":
+			config.RequireUpstreamWait = *irequpw
+		case "stats-interval":
+			config.StatsInterval = *istats
+		case "write-timeout":
+			config.WriteTimeout = *iwrite
+		case "dial-timeout":
+			config.DialTimeout = *idialto
+		case "dial-cooldown":
+			config.DialCooldown = *icool
+		case "redial-attempts":
+			config.RedialAttempts = *iredial
+		case "redial-backoff":
+			config.RedialBackoff = *ibackoff
+		case "failover-after":
+			config.FailoverAfter = *ifailovr
+		case "unreachable-reply":
+			config.UnreachableReply = *iunreach
+		case "upstream-keepalive":
+			config.UpstreamKeepalive = *ikeepal
+		case "keepalive-payload":
+			config.KeepalivePayload = *ikapay
+		case "require-prefix":
+			config.RequirePrefix = *iprefix
+		case "min-first-packet":
+			config.MinFirstPacket = *iminfst
+		case "max-connections":
+			config.MaxConnections = *imaxconn
+		case "max-per-subnet":
+			config.MaxPerSubnet = *imaxsub
+		case "subnet-prefix":
+			config.SubnetPrefix = *isubnet
+		case "subnet-prefix6":
+			config.SubnetPrefix6 = *isubnet6
+		case "rate":
+			config.Rate = *irate
+		case "burst":
+			config.Burst = *iburst
+		case "bw-server":
+			config.BandwidthServer = *ibwsrv
+		case "bw-client":
+			config.BandwidthClient = *ibwcli
+		case "allow":
+			config.Allow = splitList(*iallow)
+		case "deny":
+			config.Deny = splitList(*ideny)
+		case "enforce-acl":
+			config.EnforceACL = *ienforce
 		}
-	}()
+	})
+}
+
+// Report whether a server was given with -H, -P or -servers
+func serverFlagsSet() bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "H", "P", "servers":
+			set = true
+		}
+	})
+	return set || flag.NArg() > 0
+}
 
-	hostport := fmt.Sprintf("%s:%d", *ishost, *isport)
-	Vlogf(3, "Proxy port = %d, Server address = %s\n",
-		*ipport, hostport)
-	if setup(hostport, *ipport) {
-		RunProxy()
+// Build the configuration from flag defaults, the -config file if any, and
+// the flags given on the command line, in increasing order of precedence
+func loadConfig() (proxy.Config, error) {
+	var config proxy.Config
+	applyFlags(&config, true)
+	if (config.Echo || config.ServerUnix != "") && !serverFlagsSet() {
+		// The -H and -P defaults are no server to clash with
+		config.Servers = nil
+	}
+	if *iconfig != "" {
+		if err := proxy.LoadConfig(*iconfig, &config); err != nil {
+			return config, err
+		}
+		applyFlags(&config, false)
+	}
+	if flag.NArg() > 0 {
+		config.Servers = []string{net.JoinHostPort(*ishost, fmt.Sprint(*isport))}
+	}
+	if *iquiet {
+		config.Verbosity = proxy.LevelError
+		config.AreaVerbosity = nil
 	}
-	os.Exit(0)
+	return config, config.Validate()
 }
 
-func (p *program) Stop(s service.Service) error {
-	close(p.exit)
-	logger.Info("Stopping ", p.DisplayName)
-	if service.Interactive() {
-		os.Exit(0)
+// Write configs, with defaults filled in, as YAML that -config accepts,
+// one document per -map. The PSK is masked.
+func printConfigs(out io.Writer, configs []proxy.Config) error {
+	enc := yaml.NewEncoder(out)
+	defer enc.Close()
+	for _, config := range configs {
+		config = config.Effective()
+		if config.PSK != "" {
+			config.PSK = "redacted"
+		}
+		if err := enc.Encode(config); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-var (
-	ihelp   = flag.Bool("h", false, "Show help information")
-	ipport  = flag.Int("p", 8800, "Proxy port")
-	isport  = flag.Int("P", 8000, "Server port")
-	ishost  = flag.String("H", "192.168.32.195", "Server address")
-	iverb   = flag.Int("v", 1, "Verbosity (0-6)")
-	svcFlag = flag.String("service", "", "Control the system service.")
+// Build the configuration, then one per -map
+func loadConfigs() ([]proxy.Config, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return mapConfigs(config)
+}
+
+// Exit statuses. Those for a proxy that cannot start are kept out of the
+// SuccessExitStatus set in main, so systemd does not restart it in a loop.
+const (
+	exitInUse  = 3  // The listen address is already in use
+	exitUsage  = 64 // Malformed flags or server argument
+	exitStart  = 70 // Failed to start or run
+	exitConfig = 78 // Invalid configuration
 )
 
+// Print the flags and what each exit status means
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s: [flags] [server host:port]\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nExit status:\n")
+	fmt.Fprintf(out, "  0\tstopped, or done with -h, -version or a valid -check-config\n")
+	fmt.Fprintf(out, "  %d\tthe listen address is already in use\n", exitInUse)
+	fmt.Fprintf(out, "  %d\tmalformed flags or server argument\n", exitUsage)
+	fmt.Fprintf(out, "  %d\tfailed to start or run\n", exitStart)
+	fmt.Fprintf(out, "  %d\tinvalid configuration\n", exitConfig)
+}
+
+// Log v as log.Fatal does, but exit with code
+func fatal(code int, v ...interface{}) {
+	log.Print(v...)
+	os.Exit(code)
+}
+
 func main() {
 
 	options := make(service.KeyValue)
@@ -217,42 +772,77 @@ func main() {
 		Option: options,
 	}
 
-	//	var idrop *float64 = flag.Float64("d", 0.0, "Packet drop rate")
-	flag.Parse()
-	verbosity = *iverb
+	flag.Usage = usage
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(exitUsage)
+	}
 	if *ihelp {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if *iversion {
+		fmt.Printf("udp-proxy %s (commit %s, built %s)\n", version, commit, date)
+		os.Exit(0)
+	}
 	if flag.NArg() > 0 {
-		ok := true
-		fields := strings.Split(flag.Arg(0), ":")
-		ok = ok && len(fields) == 2
+		host, port, err := net.SplitHostPort(flag.Arg(0))
+		ok := err == nil
 		if ok {
-			*ishost = fields[0]
-			n, err := fmt.Sscanf(fields[1], "%d", isport)
+			*ishost = host
+			n, err := fmt.Sscanf(port, "%d", isport)
 			ok = ok && n == 1 && err == nil
 		}
 		if !ok {
-			flag.Usage()
-			os.Exit(0)
+			fmt.Fprintf(os.Stderr, "invalid server argument %q, expected host:port\n", flag.Arg(0))
+			os.Exit(exitUsage)
 		}
 	}
+	configs, err := loadConfigs()
+	if err != nil {
+		fatal(exitConfig, "Invalid configuration: ", err)
+	}
+	if *icheck {
+		if err := printConfigs(os.Stdout, configs); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 
 	prg := &program{
-		exit:        make(chan struct{}),
 		DisplayName: svcConfig.DisplayName,
 	}
 	s, err := service.New(prg, svcConfig)
 	if err != nil {
-		log.Fatal(err)
+		fatal(exitStart, err)
 	}
 	prg.service = s
 
 	errs := make(chan error, 5)
 	logger, err = s.Logger(errs)
 	if err != nil {
-		log.Fatal(err)
+		fatal(exitStart, err)
+	}
+
+	split, err := openLogs(configs[0].LogFormat)
+	if err != nil {
+		fatal(exitStart, err)
+	}
+	for _, config := range configs {
+		if split != nil {
+			config.Logger = split
+		}
+		// Running as a service, so log where the platform keeps service logs
+		if !service.Interactive() && config.Logger == nil {
+			config.Logger = serviceLogger{logger}
+		}
+		prg.proxies = append(prg.proxies, proxy.New(config))
+	}
+	prg.proxy = prg.proxies[0]
+	if *idrainst {
+		prg.setDraining(true)
 	}
 
 	go func() {
@@ -275,5 +865,10 @@ func main() {
 	err = s.Run()
 	if err != nil {
 		logger.Error(err)
+		var inuse *proxy.AddrInUseError
+		if errors.As(err, &inuse) {
+			os.Exit(exitInUse)
+		}
+		os.Exit(exitStart)
 	}
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/annlumia/udp-proxy/proxy"
+)
+
+// A listen port relayed to its own server, from -map port:host:port
+type mapping struct {
+	port   int
+	server string
+}
+
+// Repeatable flag collecting -map values
+type mapFlag []string
+
+func (m *mapFlag) String() string { return strings.Join(*m, ",") }
+
+func (m *mapFlag) Set(s string) error {
+	if _, err := parseMapping(s); err != nil {
+		return err
+	}
+	*m = append(*m, s)
+	return nil
+}
+
+// Define a repeatable -map style flag
+func mapVar(name, usage string) *mapFlag {
+	var m mapFlag
+	flag.Var(&m, name, usage)
+	return &m
+}
+
+// Parse port:host:port, where host may be a bracketed IPv6 address
+func parseMapping(s string) (mapping, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return mapping{}, fmt.Errorf("map %q is not port:host:port", s)
+	}
+	port, err := strconv.Atoi(s[:i])
+	if err != nil || port < 1 || port > 65535 {
+		return mapping{}, fmt.Errorf("map %q: listen port %q out of range 1-65535", s, s[:i])
+	}
+	if _, _, err := net.SplitHostPort(s[i+1:]); err != nil {
+		return mapping{}, fmt.Errorf("map %q: %v", s, err)
+	}
+	return mapping{port: port, server: s[i+1:]}, nil
+}
+
+// Expand config into one configuration per -map, each listening on its own
+// port and relaying to its own server. Without -map config is used as is.
+func mapConfigs(config proxy.Config) ([]proxy.Config, error) {
+	if len(*imap) == 0 {
+		return []proxy.Config{config}, nil
+	}
+	if config.ListenUnix != "" || config.ListenTCP != "" {
+		return nil, fmt.Errorf("map: cannot be combined with listen_unix or listen_tcp")
+	}
+	if config.Echo || config.ServerUnix != "" {
+		return nil, fmt.Errorf("map: cannot be combined with echo or server_unix")
+	}
+	host := ""
+	if config.Listen != "" {
+		host, _, _ = net.SplitHostPort(config.Listen)
+	}
+	seen := make(map[int]string)
+	var configs []proxy.Config
+	for _, s := range *imap {
+		m, err := parseMapping(s)
+		if err != nil {
+			return nil, err
+		}
+		if prev, found := seen[m.port]; found {
+			return nil, fmt.Errorf("map %q: port %d already used by %q", s, m.port, prev)
+		}
+		seen[m.port] = s
+		c := config
+		c.Port = m.port
+		c.Listen = ""
+		if host != "" {
+			c.Listen = net.JoinHostPort(host, strconv.Itoa(m.port))
+		}
+		c.Servers = []string{m.server}
+		// One capture and state file per proxy, named after its port
+		if c.Pcap != "" {
+			c.Pcap = fmt.Sprintf("%s.%d", c.Pcap, m.port)
+		}
+		if c.StateFile != "" {
+			c.StateFile = fmt.Sprintf("%s.%d", c.StateFile, m.port)
+		}
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("map %q: %v", s, err)
+		}
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
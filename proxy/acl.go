@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Parse a list of CIDRs. A bare IP address is taken as a single host.
+func parseCIDRList(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, field := range list {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// Report whether any network in nets contains ip
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether a client at ip may use the proxy. The deny list takes
+// precedence, and an empty allow list admits everyone not denied.
+func (s *settings) allowedClient(ip net.IP) bool {
+	if containsIP(s.denyNets, ip) {
+		return false
+	}
+	return len(s.allowNets) == 0 || containsIP(s.allowNets, ip)
+}
+
+// Report whether the client at addr may use the proxy. Clients without an
+// IP address, on the unix socket, are not subject to the lists.
+func (s *settings) allowedAddr(addr net.Addr) bool {
+	if udpaddr, ok := addr.(*net.UDPAddr); ok {
+		return s.allowedClient(udpaddr.IP)
+	}
+	return true
+}
+
+// Log how many entries the allow and deny lists of s hold
+func (p *Proxy) logACL(s *settings) {
+	if len(s.allowNets) > 0 || len(s.denyNets) > 0 {
+		p.Vlogf(LevelInfo, "Loaded %d allow and %d deny entries\n",
+			len(s.allowNets), len(s.denyNets))
+	}
+}
+
+// Close the connections of clients s refuses, after the lists have been
+// reloaded with EnforceACL set
+func (p *Proxy) enforceACL(s *settings) {
+	p.clientDict.each(func(shard *dictShard, key string, conn *Connection) {
+		if !s.allowedAddr(conn.client()) {
+			fields := conn.fields()
+			p.removeConnection(shard, key, conn)
+			p.Vlogs(LevelInfo, "closed refused connection", fields,
+				"Closed connection for client %s refused by the reloaded lists\n", fields.Client)
+		}
+	})
+}
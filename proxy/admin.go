@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A live connection as reported by Connections
+type ConnectionInfo struct {
+	ID         uint64  `json:"id"`          // Connection ID, as logged
+	Client     string  `json:"client"`      // Latest client address, prefixed with tcp/ for bridged clients
+	Server     string  `json:"server"`      // Server the client is pinned to, empty in echo mode
+	C2SBytes   uint64  `json:"c2s_bytes"`   // Bytes relayed from client to server
+	C2SPackets uint64  `json:"c2s_packets"` // Datagrams relayed from client to server
+	S2CBytes   uint64  `json:"s2c_bytes"`   // Bytes relayed from server to client
+	S2CPackets uint64  `json:"s2c_packets"` // Datagrams relayed from server to client
+	Age        float64 `json:"age_seconds"` // Time since the connection was created
+	RTT        float64 `json:"rtt_seconds"` // Latest round trip estimate with RTTProbe, 0 if none
+}
+
+// Snapshot of the connections in the client dictionary
+func (p *Proxy) Connections() []ConnectionInfo {
+	var list []ConnectionInfo
+	p.clientDict.each(func(_ *dictShard, _ string, conn *Connection) {
+		st := conn.Stats()
+		server := ""
+		if srvAddr := conn.server(); srvAddr != nil {
+			server = srvAddr.String()
+		}
+		list = append(list, ConnectionInfo{
+			ID:         conn.ID,
+			Client:     conn.clientName(),
+			Server:     server,
+			C2SBytes:   st.C2SBytes,
+			C2SPackets: st.C2SPackets,
+			S2CBytes:   st.S2CBytes,
+			S2CPackets: st.S2CPackets,
+			Age:        st.Duration.Round(time.Millisecond).Seconds(),
+			RTT:        time.Duration(atomic.LoadInt64(&conn.rtt)).Seconds(),
+		})
+	})
+	return list
+}
+
+// Close the connections of client, given as reported by Connections; there
+// is more than one with PacketInfo, when it sent to several local addresses.
+// Returns false if there is no such connection.
+func (p *Proxy) CloseConnection(client string) bool {
+	found := false
+	p.clientDict.each(func(shard *dictShard, key string, conn *Connection) {
+		if conn.clientName() != client {
+			return
+		}
+		found = true
+		fields := conn.fields()
+		p.removeConnection(shard, key, conn)
+		p.Vlogs(LevelInfo, "closed connection by request", fields,
+			"Closed connection for client %s by admin request\n", fields.Client)
+	})
+	return found
+}
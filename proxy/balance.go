@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Split a server entry of the form host:port or host:port=weight. The
+// weight defaults to 1.
+func parseServer(entry string) (hostport string, weight int, err error) {
+	i := strings.LastIndex(entry, "=")
+	if i < 0 {
+		return entry, 1, nil
+	}
+	weight, err = strconv.Atoi(entry[i+1:])
+	if err != nil || weight < 1 {
+		return "", 0, fmt.Errorf("%q has weight %q, want a positive integer", entry, entry[i+1:])
+	}
+	return entry[:i], weight, nil
+}
+
+// Smooth weighted round-robin as used by nginx: each pick raises every
+// server's current weight by its weight, then takes the server with the
+// highest and lowers it by the total. Servers are picked in proportion to
+// their weights with picks of the same server spread out.
+type weightedRR struct {
+	weights []int
+	total   int
+
+	// Current weights, guarded by wmutex
+	current []int
+	wmutex  sync.Mutex
+}
+
+// Balancer for weights, nil if they are all equal and plain round-robin
+// does the same job without a lock
+func newWeightedRR(weights []int) *weightedRR {
+	equal := true
+	total := 0
+	for _, w := range weights {
+		equal = equal && w == weights[0]
+		total += w
+	}
+	if equal {
+		return nil
+	}
+	return &weightedRR{
+		weights: weights,
+		total:   total,
+		current: make([]int, len(weights)),
+	}
+}
+
+// Index of the next server. Safe for concurrent use.
+func (b *weightedRR) next() int {
+	b.wmutex.Lock()
+	defer b.wmutex.Unlock()
+	best := 0
+	for i, w := range b.weights {
+		b.current[i] += w
+		if b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	b.current[best] -= b.total
+	return best
+}
+
+// Points each unit of weight puts on the hash ring. More spread clients
+// more evenly at the cost of a larger ring.
+const ringPoints = 100
+
+// Consistent hash ring over the servers. Points are placed by hashing the
+// server entries as configured, so a client maps to the same server across
+// restarts and DNS changes, and adding or removing a server only moves the
+// clients on the arcs it gains or loses.
+type hashRing struct {
+	points  []uint32 // Sorted
+	servers []int    // Index of the server owning each point
+}
+
+// Ring over servers, given as host:port entries with their weights
+func newHashRing(servers []string, weights []int) *hashRing {
+	r := &hashRing{}
+	for i, entry := range servers {
+		hostport, _, _ := parseServer(entry)
+		for j := 0; j < ringPoints*weights[i]; j++ {
+			r.points = append(r.points, ringHash(hostport+"#"+strconv.Itoa(j)))
+			r.servers = append(r.servers, i)
+		}
+	}
+	sort.Sort(r)
+	return r
+}
+
+func (r *hashRing) Len() int           { return len(r.points) }
+func (r *hashRing) Less(i, j int) bool { return r.points[i] < r.points[j] }
+func (r *hashRing) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.servers[i], r.servers[j] = r.servers[j], r.servers[i]
+}
+
+func ringHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// Index of the server owning key: the first, going round the ring from the
+// hash of key, for which ok reports true, or the owner of the hash itself if
+// none does
+func (r *hashRing) pick(key string, ok func(i int) bool) int {
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	for k := 0; k < len(r.points); k++ {
+		if i := r.servers[(start+k)%len(r.points)]; ok(i) {
+			return i
+		}
+	}
+	return r.servers[start%len(r.points)]
+}
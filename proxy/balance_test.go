@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Over many connections each server is picked in proportion to its weight,
+// and every run of total picks already matches the weights exactly
+func TestWeightedRRSpread(t *testing.T) {
+	tests := []struct {
+		weights []int
+		first   []int // Picks of the first cycle, nil to skip the check
+	}{
+		{weights: []int{3, 1}, first: []int{0, 0, 1, 0}},
+		{weights: []int{1, 3}, first: []int{1, 0, 1, 1}},
+		{weights: []int{5, 1, 1}, first: []int{0, 0, 1, 0, 2, 0, 0}},
+		{weights: []int{2, 3, 5}},
+		{weights: []int{1, 1, 10}},
+		{weights: []int{7, 2, 2, 1}},
+	}
+	const cycles = 1000
+	for _, tt := range tests {
+		b := newWeightedRR(tt.weights)
+		if b == nil {
+			t.Fatalf("weights %v: no balancer", tt.weights)
+		}
+		total := 0
+		for _, w := range tt.weights {
+			total += w
+		}
+		counts := make([]int, len(tt.weights))
+		for c := 0; c < cycles; c++ {
+			cycle := make([]int, len(tt.weights))
+			var picks []int
+			for i := 0; i < total; i++ {
+				n := b.next()
+				cycle[n]++
+				counts[n]++
+				picks = append(picks, n)
+			}
+			if !reflect.DeepEqual(cycle, tt.weights) {
+				t.Fatalf("weights %v: cycle %d picked %v", tt.weights, c, cycle)
+			}
+			if c == 0 && tt.first != nil && !reflect.DeepEqual(picks, tt.first) {
+				t.Errorf("weights %v: first cycle %v, want %v", tt.weights, picks, tt.first)
+			}
+		}
+		for i, w := range tt.weights {
+			if want := w * cycles; counts[i] != want {
+				t.Errorf("weights %v: server %d picked %d times, want %d", tt.weights, i, counts[i], want)
+			}
+		}
+	}
+}
+
+// Equal weights leave the picking to plain round-robin
+func TestWeightedRREqual(t *testing.T) {
+	for _, weights := range [][]int{{1}, {1, 1}, {4, 4, 4}} {
+		if b := newWeightedRR(weights); b != nil {
+			t.Errorf("weights %v: got a balancer, want nil", weights)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// recvmmsg and sendmmsg move several datagrams per system call on Linux
+const haveBatch = true
+
+// Either family's PacketConn; their Message types are the same
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// Batch interface to c for the family of its local address
+func newBatchConn(c *net.UDPConn) batchConn {
+	if c.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		return ipv4.NewPacketConn(c)
+	}
+	return ipv6.NewPacketConn(c)
+}
+
+// Relay loop of runProxy reading up to Batch datagrams per system call.
+// Returns once the proxy is closed.
+func (p *Proxy) runProxyBatch(pudp *net.UDPConn) {
+	r := newBatchConn(pudp)
+	msgs := make([]ipv4.Message, p.config.Batch)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, p.config.BufferSize)}
+		if p.pktinfo {
+			msgs[i].OOB = newPacketInfoBuffer()
+		}
+	}
+	for {
+		n, err := r.ReadBatch(msgs, 0)
+		if errors.Is(err, net.ErrClosed) || err != nil && p.stopping() {
+			return
+		}
+		if p.checkreport(LevelError, err) {
+			if !p.readBackoff() {
+				return
+			}
+			continue
+		}
+		for i := range msgs[:n] {
+			m := &msgs[i]
+			cliaddr, _ := m.Addr.(*net.UDPAddr)
+			if cliaddr == nil {
+				continue
+			}
+			if !p.relayClientDatagram(pudp, cliaddr, m.Buffers[0], m.N, m.OOB[:m.NN], m.Flags) {
+				return
+			}
+		}
+	}
+}
+
+// Write due to conn's own server socket with sendmmsg, holding smutex as
+// writeToServer does. Returns the result of each write.
+func (p *Proxy) writeBatchToServer(conn *Connection, due []delayed) []error {
+	msgs := make([]ipv4.Message, len(due))
+	conn.smutex.RLock()
+	defer conn.smutex.RUnlock()
+	for i, d := range due {
+		msgs[i].Buffers = [][]byte{p.serverCodec.pack(d.data)}
+		if conn.ServerAddr.IP.IsMulticast() {
+			// Unconnected, as writeServer explains
+			msgs[i].Addr = conn.ServerAddr
+		}
+	}
+	if conn.closed {
+		errs := make([]error, len(due))
+		for i := range errs {
+			errs[i] = errConnectionClosed
+		}
+		return errs
+	}
+	p.armWrite(conn.ServerConn)
+	return writeBatch(newBatchConn(conn.ServerConn), msgs)
+}
+
+// Write due to conn's UDP client with sendmmsg, sealed if PSK is set and
+// from the address chosen by replyOOB, as writeToClient does. Returns the
+// result of each write.
+func (p *Proxy) writeBatchToClient(conn *Connection, due []delayed) []error {
+	errs := make([]error, len(due))
+	msgs := make([]ipv4.Message, 0, len(due))
+	// Index into due of each message
+	index := make([]int, 0, len(due))
+	for i, d := range due {
+		data := p.clientCodec.pack(d.data)
+		if p.psk != nil {
+			sealed, err := p.psk.seal(data)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			data = sealed
+		}
+		msgs = append(msgs, ipv4.Message{
+			Buffers: [][]byte{data},
+			OOB:     conn.replyOOB,
+			Addr:    conn.client(),
+		})
+		index = append(index, i)
+	}
+	pc := conn.replyConn.(*net.UDPConn)
+	p.armWrite(pc)
+	for i, err := range writeBatch(newBatchConn(pc), msgs) {
+		errs[index[i]] = err
+	}
+	return errs
+}
+
+// Write msgs with as few sendmmsg calls as possible. A failed datagram is
+// charged with the error and the rest of the batch is still written.
+// Returns the result of each write.
+func writeBatch(c batchConn, msgs []ipv4.Message) []error {
+	errs := make([]error, len(msgs))
+	for off := 0; off < len(msgs); {
+		n, err := c.WriteBatch(msgs[off:], 0)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		off += n
+		if err != nil && off < len(msgs) {
+			errs[off] = err
+			off++
+		}
+	}
+	return errs
+}
@@ -0,0 +1,88 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Datagrams queued per round of the read benchmarks, as with Batch 32
+const benchBatch = 32
+
+// Loopback sender and receiver, with batch already queued by the sender
+// before each round of reads
+func benchSockets(b *testing.B) (send batchConn, recv *net.UDPConn, batch []ipv4.Message) {
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	c, err := net.DialUDP("udp4", nil, recv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		recv.Close()
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		c.Close()
+		recv.Close()
+	})
+	batch = make([]ipv4.Message, benchBatch)
+	for i := range batch {
+		batch[i].Buffers = [][]byte{make([]byte, 64)}
+	}
+	return newBatchConn(c), recv, batch
+}
+
+// Queue a round of datagrams on the receiver, sent with one sendmmsg so the
+// sending costs the same for both read paths
+func sendRound(b *testing.B, send batchConn, batch []ipv4.Message) {
+	for sent := 0; sent < len(batch); {
+		n, err := send.WriteBatch(batch[sent:], 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sent += n
+	}
+}
+
+// Small datagrams read one recvmsg each, as runProxy does without Batch
+func BenchmarkReadSingle(b *testing.B) {
+	send, recv, batch := benchSockets(b)
+	buffer := make([]byte, DefaultBufferSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += benchBatch {
+		sendRound(b, send, batch)
+		for j := 0; j < benchBatch; j++ {
+			if _, _, _, _, err := recv.ReadMsgUDP(buffer, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// The same datagrams read up to benchBatch per recvmmsg, as runProxyBatch
+// does
+func BenchmarkReadBatch(b *testing.B) {
+	send, recv, batch := benchSockets(b)
+	r := newBatchConn(recv)
+	msgs := make([]ipv4.Message, benchBatch)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, DefaultBufferSize)}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += benchBatch {
+		sendRound(b, send, batch)
+		for got := 0; got < benchBatch; {
+			n, err := r.ReadBatch(msgs[:benchBatch-got], 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			got += n
+		}
+	}
+}
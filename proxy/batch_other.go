@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import "net"
+
+// Batches need recvmmsg and sendmmsg, which are Linux only, so datagrams
+// are read and written one at a time elsewhere
+const haveBatch = false
+
+func (p *Proxy) runProxyBatch(pudp *net.UDPConn) {}
+
+func (p *Proxy) writeBatchToServer(conn *Connection, due []delayed) []error { return nil }
+
+func (p *Proxy) writeBatchToClient(conn *Connection, due []delayed) []error { return nil }
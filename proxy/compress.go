@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compresses one leg datagram by datagram, for a bandwidth constrained link
+// between two proxies: one with Compress towards its servers, the other
+// with CompressClient towards its clients. Each datagram on the leg is
+//
+//	marker (1 byte) || payload
+//
+// where the marker is packRaw for a payload sent as is, or packLZ4 for an
+// LZ4 block, used only when that is smaller. A packed datagram is one byte
+// longer at worst.
+type codec struct {
+	compressors sync.Pool // *lz4.Compressor, which are not safe to share
+	buffers     sync.Pool // *[]byte of MaxUDPPayload bytes to unpack into
+}
+
+// Markers leading each packed datagram
+const (
+	packRaw = 0
+	packLZ4 = 1
+)
+
+// Codec for the algorithm named by Compress or CompressClient, nil if the
+// name is empty
+func newCodec(name string) *codec {
+	if name == "" {
+		return nil
+	}
+	c := new(codec)
+	c.compressors.New = func() interface{} { return new(lz4.Compressor) }
+	c.buffers.New = func() interface{} {
+		b := make([]byte, MaxUDPPayload)
+		return &b
+	}
+	return c
+}
+
+// Compress data into a new marked datagram, or copy it raw if that is no
+// smaller. A nil codec returns data unchanged.
+func (c *codec) pack(data []byte) []byte {
+	if c == nil {
+		return data
+	}
+	out := make([]byte, 1+len(data))
+	if len(data) > 1 {
+		comp := c.compressors.Get().(*lz4.Compressor)
+		// One byte short of data, so a block that fits has saved something
+		n, err := comp.CompressBlock(data, out[1:len(data)])
+		c.compressors.Put(comp)
+		if err == nil && n > 0 {
+			out[0] = packLZ4
+			return out[:1+n]
+		}
+	}
+	out[0] = packRaw
+	copy(out[1:], data)
+	return out
+}
+
+// Undo pack. Returns the datagram, nil if data is not a packed datagram,
+// and the buffer it was unpacked into, nil if none was needed, to hand back
+// with release once the datagram has been relayed. A nil codec returns
+// data unchanged.
+func (c *codec) unpack(data []byte) ([]byte, *[]byte) {
+	if c == nil {
+		return data, nil
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	switch data[0] {
+	case packRaw:
+		return data[1:], nil
+	case packLZ4:
+		bufp := c.buffers.Get().(*[]byte)
+		n, err := lz4.UncompressBlock(data[1:], *bufp)
+		if err != nil {
+			c.buffers.Put(bufp)
+			return nil, nil
+		}
+		return (*bufp)[:n], bufp
+	}
+	return nil, nil
+}
+
+// Hand back a buffer from unpack
+func (c *codec) release(bufp *[]byte) {
+	if bufp != nil {
+		c.buffers.Put(bufp)
+	}
+}
+
+// Unpack a datagram read from a leg compressed with c, counting and
+// logging it as dropped if it is malformed
+func (p *Proxy) unpackFrom(c *codec, from string, data []byte, fields Fields) ([]byte, *[]byte) {
+	unpacked, bufp := c.unpack(data)
+	if unpacked == nil {
+		p.countDrop(dropPolicy)
+		p.Vlogs(LevelInfo, "dropped malformed compressed packet", fields,
+			"Dropped packet from %s for client %s that failed to decompress\n", from, fields.Client)
+	}
+	return unpacked, bufp
+}
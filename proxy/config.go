@@ -0,0 +1,461 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Largest payload a UDP datagram can carry
+const MaxUDPPayload = 65507
+
+// Most datagrams a batch read may take at once
+const MaxBatch = 1024
+
+// Defaults applied to zero-valued Config fields
+const (
+	DefaultNetwork         = "udp"
+	DefaultBufferSize      = 1500
+	DefaultShutdownTimeout = 5 * time.Second
+	DefaultLogFormat       = "text"
+	DefaultConnModel       = "goroutine"
+	DefaultBalance         = "roundrobin"
+	DefaultHexDumpBytes    = 64
+	DefaultRedialBackoff   = 100 * time.Millisecond
+	DefaultDialTimeout     = 5 * time.Second
+	DefaultProbeTimeout    = time.Second
+	DefaultRequireWait     = 5 * time.Second
+	DefaultSubnetPrefix    = 24
+	DefaultSubnetPrefix6   = 64
+)
+
+// Settings for a Proxy. The yaml tags name the keys accepted by LoadConfig.
+type Config struct {
+	Port                 int           `yaml:"port"`                   // Port clients send to
+	Listen               string        `yaml:"listen"`                 // Address clients send to as host:port, overrides Port; empty listens on all addresses
+	Servers              []string      `yaml:"servers"`                // Server addresses as host:port, optionally followed by =weight
+	Balance              string        `yaml:"balance"`                // "roundrobin" spreads new clients over Servers by weight, "consistent" hashes each client IP onto a ring of them
+	Network              string        `yaml:"network"`                // "udp" (dual-stack), "udp4" or "udp6"
+	KeyByIP              bool          `yaml:"key_by_ip"`              // Key clients by IP alone, replying to the port each last sent from; clients sharing an IP share one connection
+	PacketInfo           bool          `yaml:"pktinfo"`                // Key clients by the local address they sent to as well; replies always leave from it
+	ListenUnix           string        `yaml:"listen_unix"`            // Serve clients on this unix datagram socket instead of UDP
+	ServerUnix           string        `yaml:"server_unix"`            // Relay to the server on this unix datagram socket instead of over UDP
+	Batch                int           `yaml:"batch"`                  // Datagrams read per system call on each proxy socket, Linux only; 0 or 1 reads one at a time
+	Workers              int           `yaml:"workers"`                // Proxy sockets sharing the port through SO_REUSEPORT, Linux only
+	ConnModel            string        `yaml:"conn_model"`             // "goroutine" reads each server socket on a routine of its own, "pool" reads them all on ConnWorkers routines, Linux only
+	ConnWorkers          int           `yaml:"conn_workers"`           // Routines reading server sockets with ConnModel "pool", 0 for GOMAXPROCS
+	ListenTCP            string        `yaml:"listen_tcp"`             // Also bridge length-framed TCP clients on this address
+	Verbosity            int           `yaml:"verbosity"`              // Log verbosity from LevelQuiet (0, the default) to LevelAll (6)
+	ReadBuffer           int           `yaml:"read_buffer"`            // Kernel receive buffer for each socket in bytes, 0 keeps the default
+	WriteBuffer          int           `yaml:"write_buffer"`           // Kernel send buffer for each socket in bytes, 0 keeps the default
+	BufferSize           int           `yaml:"buffer_size"`            // Datagram read buffer size in bytes
+	MaxPacket            int           `yaml:"max_packet"`             // Drop client datagrams larger than this many bytes, 0 for no limit
+	DropRate             float64       `yaml:"drop_rate"`              // Probability of dropping each relayed datagram
+	DupRate              float64       `yaml:"dup_rate"`               // Probability of sending each relayed datagram twice, rolled for each direction apart
+	Delay                time.Duration `yaml:"delay"`                  // Hold each relayed datagram this long, emulating latency
+	Jitter               time.Duration `yaml:"jitter"`                 // Hold each relayed datagram up to this much longer, at random
+	Reorder              bool          `yaml:"reorder"`                // Let a datagram with less jitter overtake earlier ones
+	Seed                 int64         `yaml:"seed"`                   // Random seed for drops, 0 uses the current time
+	IdleTimeout          time.Duration `yaml:"idle_timeout"`           // Close connections idle this long, 0 disables
+	MaxLifetime          time.Duration `yaml:"max_lifetime"`           // Close connections open this long even if busy, 0 disables
+	MaxPackets           int64         `yaml:"max_packets"`            // Close a connection once this many datagrams have been relayed each way, 0 disables
+	ShutdownTimeout      time.Duration `yaml:"shutdown_timeout"`       // Maximum time Close waits for routines to finish
+	ResolveInterval      time.Duration `yaml:"resolve_interval"`       // Resolve the servers again this often for new connections, 0 disables
+	HealthProbeInterval  time.Duration `yaml:"health_probe_interval"`  // Probe every server this often, sending new clients only to those that pass; 0 disables
+	HealthProbe          string        `yaml:"health_probe"`           // Probe payload a healthy server replies to; empty sends an empty datagram and only fails on a refusal
+	HealthProbeTimeout   time.Duration `yaml:"health_probe_timeout"`   // Wait this long for a probe reply
+	RequireUpstream      string        `yaml:"require_upstream"`       // Before starting, check every server replies to HealthProbe with "udp", or accepts a TCP connection with "tcp"; empty skips the check
+	RequireUpstreamWait  time.Duration `yaml:"require_upstream_wait"`  // Fail startup if a server cannot be reached within this long
+	StatsInterval        time.Duration `yaml:"stats_interval"`         // Log traffic totals this often, 0 disables
+	WriteTimeout         time.Duration `yaml:"write_timeout"`          // Drop a datagram whose write blocks this long, 0 disables
+	DialTimeout          time.Duration `yaml:"dial_timeout"`           // Give up opening a server socket after this long
+	DialCooldown         time.Duration `yaml:"dial_cooldown"`          // Refuse new clients for a server this long after dialing it fails, 0 disables
+	RedialAttempts       int           `yaml:"redial_attempts"`        // Times to redial a failed server socket before dropping the connection
+	RedialBackoff        time.Duration `yaml:"redial_backoff"`         // Wait before the first redial, doubled after each failure
+	FailoverAfter        int           `yaml:"failover_after"`         // Move a connection to another server after this many datagrams in a row are refused, 0 closes it instead
+	UnreachableReply     string        `yaml:"unreachable_reply"`      // Payload sent to a client whose server refuses its datagrams, empty sends nothing
+	UpstreamKeepalive    time.Duration `yaml:"upstream_keepalive"`     // Send KeepalivePayload to a connection's server after this long without client traffic, 0 disables
+	KeepalivePayload     string        `yaml:"keepalive_payload"`      // Payload of upstream keepalives, empty for a zero-length datagram
+	RequirePrefix        string        `yaml:"require_prefix"`         // Hex bytes a new client's first datagram or TCP frame must start with to get a connection
+	MinFirstPacket       int           `yaml:"min_first_packet"`       // Bytes a new client's first datagram or TCP frame must have to get a connection
+	MaxConnections       int           `yaml:"max_connections"`        // Most client connections open at once, 0 for no limit
+	MaxPerSubnet         int           `yaml:"max_per_subnet"`         // Most client connections open at once from one subnet, 0 for no limit
+	SubnetPrefix         int           `yaml:"subnet_prefix"`          // Prefix length grouping IPv4 clients into subnets for MaxPerSubnet
+	SubnetPrefix6        int           `yaml:"subnet_prefix6"`         // Prefix length grouping IPv6 clients into subnets for MaxPerSubnet
+	Rate                 float64       `yaml:"rate"`                   // Per-client packets/sec, 0 disables
+	Burst                int           `yaml:"burst"`                  // Per-client burst, 0 uses Rate rounded up
+	BandwidthServer      float64       `yaml:"bandwidth_server"`       // Per-connection bytes/sec towards the server, 0 for no limit
+	BandwidthClient      float64       `yaml:"bandwidth_client"`       // Per-connection bytes/sec towards the client, 0 for no limit
+	Allow                []string      `yaml:"allow"`                  // Client CIDRs allowed, empty allows all
+	Deny                 []string      `yaml:"deny"`                   // Client CIDRs refused
+	EnforceACL           bool          `yaml:"enforce_acl"`            // On reload, close existing connections of clients the new Allow and Deny lists refuse
+	DSCPServer           int           `yaml:"dscp_server"`            // DSCP codepoint marked on datagrams sent to servers, 0-63
+	DSCPClient           int           `yaml:"dscp_client"`            // DSCP codepoint marked on datagrams sent to clients, 0-63
+	TTLServer            int           `yaml:"ttl_server"`             // IP TTL or hop limit of datagrams sent to servers, 1-255; 0 keeps the system default
+	McastIface           string        `yaml:"mcast_iface"`            // Interface multicast group servers are sent to and joined on; empty uses the system default
+	McastTTL             int           `yaml:"mcast_ttl"`              // IP TTL or hop limit of datagrams sent to multicast group servers, 1-255; 0 keeps the system default of 1
+	TTLClient            int           `yaml:"ttl_client"`             // IP TTL or hop limit of datagrams sent to clients, 1-255; 0 keeps the system default
+	DFServer             bool          `yaml:"df_server"`              // Set Don't Fragment on datagrams sent to servers, so oversized ones fail instead, Linux only
+	DFClient             bool          `yaml:"df_client"`              // Set Don't Fragment on datagrams sent to clients, so oversized ones fail instead, Linux only
+	Compress             string        `yaml:"compress"`               // Compress datagrams to servers, and decompress replies, with this algorithm: lz4, for a proxy with CompressClient at the far end; empty disables
+	CompressClient       string        `yaml:"compress_client"`        // Decompress datagrams from clients, and compress replies, with this algorithm, for a client that is a proxy with Compress; empty disables
+	PSK                  string        `yaml:"psk"`                    // Hex encoded AES-256 key sealing datagrams between clients and proxy, empty disables; resent datagrams are not detected
+	Mirror               string        `yaml:"mirror"`                 // Also copy every client datagram to this host:port, discarding its replies
+	Echo                 bool          `yaml:"echo"`                   // Reflect datagrams back to their clients instead of relaying them to servers
+	SingleUpstreamSocket bool          `yaml:"single_upstream_socket"` // Talk to the servers over one socket, matching replies to requests in order
+	Collapse             string        `yaml:"collapse"`               // Send for every client from this one local host:port, implying SingleUpstreamSocket
+	SourceIP             string        `yaml:"source_ip"`              // Local IP server sockets are bound to, empty lets the system choose
+	LocalPortRange       string        `yaml:"local_port_range"`       // Local ports server sockets are bound to as lo-hi, for firewalls that only pass those; empty lets the system choose
+	ProxyProtocol        bool          `yaml:"proxy_protocol"`         // Prepend a PROXY protocol v2 header to each connection's first datagram
+	HexDump              bool          `yaml:"hexdump"`                // Log sizes instead of raw payloads, with hex dumps at trace verbosity
+	HexDumpBytes         int           `yaml:"hexdump_bytes"`          // Payload bytes included in each hex dump
+	Checksum             bool          `yaml:"checksum"`               // Log the CRC32 of each datagram before and after the transformer at trace verbosity
+	RTTProbe             bool          `yaml:"rtt_probe"`              // Estimate each connection's round trip from the gap between a datagram to the server and the next one back
+	Pcap                 string        `yaml:"pcap"`                   // Write relayed datagrams to this pcap file, empty disables
+	StateFile            string        `yaml:"state_file"`             // Save client server assignments here on shutdown and restore them on start, empty disables
+	LogFormat            string        `yaml:"log_format"`             // "text" or "json"
+	Logger               Logger        `yaml:"-"`                      // Destination for log output, nil uses the log package
+	Transformer          Transformer   `yaml:"-"`                      // Payload rewriting hook, nil relays payloads unchanged
+
+	// Verbosity of the proxy (datagrams from clients), conn (datagrams
+	// from servers) and errors areas, each overriding Verbosity
+	AreaVerbosity map[string]int `yaml:"area_verbosity"`
+
+	// Called when a connection is created, with a nil server in echo mode,
+	// and when it has been torn down. Both may be called from many routines
+	// at once, but never with the client dictionary locked, so they may
+	// call back into the Proxy.
+	OnConnect    func(client, server net.Addr)   `yaml:"-"`
+	OnDisconnect func(client net.Addr, st Stats) `yaml:"-"`
+}
+
+// Read a YAML or JSON configuration file into config, then validate the
+// result. Keys missing from the file leave the existing values in place,
+// and unknown keys are rejected. Durations are written like "30s".
+func LoadConfig(path string, config *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// JSON is a subset of YAML, so one decoder handles both formats
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(config); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// Config as a proxy created from it runs, with the defaults New fills in
+func (c Config) Effective() Config {
+	c.setDefaults()
+	return c
+}
+
+// Fill in defaults for zero-valued fields
+func (c *Config) setDefaults() {
+	if c.Network == "" {
+		c.Network = DefaultNetwork
+	}
+	if c.BufferSize == 0 {
+		c.BufferSize = DefaultBufferSize
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if c.HealthProbeTimeout == 0 {
+		c.HealthProbeTimeout = DefaultProbeTimeout
+	}
+	if c.RequireUpstreamWait == 0 {
+		c.RequireUpstreamWait = DefaultRequireWait
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = DefaultDialTimeout
+	}
+	if c.RedialBackoff == 0 {
+		c.RedialBackoff = DefaultRedialBackoff
+	}
+	if c.Workers == 0 {
+		c.Workers = 1
+	}
+	if c.HexDumpBytes == 0 {
+		c.HexDumpBytes = DefaultHexDumpBytes
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = DefaultLogFormat
+	}
+	if c.ConnModel == "" {
+		c.ConnModel = DefaultConnModel
+	}
+	if c.Balance == "" {
+		c.Balance = DefaultBalance
+	}
+	if c.SubnetPrefix == 0 {
+		c.SubnetPrefix = DefaultSubnetPrefix
+	}
+	if c.SubnetPrefix6 == 0 {
+		c.SubnetPrefix6 = DefaultSubnetPrefix6
+	}
+}
+
+// Check the configuration, naming the first invalid field
+func (c Config) Validate() error {
+	c.setDefaults()
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("port: %d out of range 0-65535", c.Port)
+	}
+	if c.Verbosity < LevelQuiet || c.Verbosity > LevelAll {
+		return fmt.Errorf("verbosity: %d out of range %d-%d", c.Verbosity, LevelQuiet, LevelAll)
+	}
+	for name, level := range c.AreaVerbosity {
+		if _, found := areaNames[name]; !found {
+			return fmt.Errorf("area_verbosity: %q is not one of proxy, conn, errors", name)
+		}
+		if level < LevelQuiet || level > LevelAll {
+			return fmt.Errorf("area_verbosity: %s %d out of range %d-%d", name, level, LevelQuiet, LevelAll)
+		}
+	}
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("listen: %v", err)
+		}
+	}
+	if c.ListenUnix != "" && c.Listen != "" {
+		return fmt.Errorf("listen_unix: cannot be combined with listen")
+	}
+	if c.Batch < 0 || c.Batch > MaxBatch {
+		return fmt.Errorf("batch: %d out of range 0-%d", c.Batch, MaxBatch)
+	}
+	if c.Workers < 1 {
+		return fmt.Errorf("workers: %d is less than 1", c.Workers)
+	}
+	switch c.Balance {
+	case "roundrobin", "consistent":
+	default:
+		return fmt.Errorf("balance: %q is not roundrobin or consistent", c.Balance)
+	}
+	switch c.ConnModel {
+	case "goroutine", "pool":
+	default:
+		return fmt.Errorf("conn_model: %q is not goroutine or pool", c.ConnModel)
+	}
+	if c.ConnWorkers < 0 {
+		return fmt.Errorf("conn_workers: %d is negative", c.ConnWorkers)
+	}
+	if c.Compress != "" && c.Compress != "lz4" {
+		return fmt.Errorf("compress: %q is not lz4", c.Compress)
+	}
+	if c.CompressClient != "" && c.CompressClient != "lz4" {
+		return fmt.Errorf("compress_client: %q is not lz4", c.CompressClient)
+	}
+	if _, err := newPSK(c.PSK); err != nil {
+		return fmt.Errorf("psk: %v", err)
+	}
+	if c.Mirror != "" {
+		if _, _, err := net.SplitHostPort(c.Mirror); err != nil {
+			return fmt.Errorf("mirror: %v", err)
+		}
+	}
+	if c.Collapse != "" {
+		if _, _, err := net.SplitHostPort(c.Collapse); err != nil {
+			return fmt.Errorf("collapse: %v", err)
+		}
+		if c.Echo {
+			return fmt.Errorf("collapse: cannot be combined with echo")
+		}
+	}
+	if c.LocalPortRange != "" {
+		if _, _, err := parsePortRange(c.LocalPortRange); err != nil {
+			return fmt.Errorf("local_port_range: %v", err)
+		}
+		if c.Collapse != "" {
+			return fmt.Errorf("local_port_range: cannot be combined with collapse, which sets the source address itself")
+		}
+	}
+	if c.SourceIP != "" {
+		if net.ParseIP(c.SourceIP) == nil {
+			return fmt.Errorf("source_ip: %q is not an IP address", c.SourceIP)
+		}
+		if c.Collapse != "" {
+			return fmt.Errorf("source_ip: cannot be combined with collapse, which sets the source address itself")
+		}
+	}
+	if c.Echo && len(c.Servers) > 0 {
+		return fmt.Errorf("echo: cannot be combined with servers")
+	}
+	if c.ServerUnix != "" {
+		switch {
+		case len(c.Servers) > 0:
+			return fmt.Errorf("server_unix: cannot be combined with servers")
+		case c.Echo:
+			return fmt.Errorf("server_unix: cannot be combined with echo")
+		case c.SingleUpstreamSocket || c.Collapse != "":
+			return fmt.Errorf("server_unix: cannot be combined with single_upstream_socket or collapse")
+		}
+	}
+	if !c.Echo && c.ServerUnix == "" && len(c.Servers) == 0 {
+		return fmt.Errorf("servers: at least one server is required")
+	}
+	for _, entry := range c.Servers {
+		if _, _, err := parseServer(entry); err != nil {
+			return fmt.Errorf("servers: %v", err)
+		}
+	}
+	switch c.Network {
+	case "udp", "udp4", "udp6":
+	default:
+		return fmt.Errorf("network: %q is not udp, udp4 or udp6", c.Network)
+	}
+	if c.BufferSize < 1 || c.BufferSize > MaxUDPPayload {
+		return fmt.Errorf("buffer_size: %d out of range 1-%d", c.BufferSize, MaxUDPPayload)
+	}
+	if c.MaxPacket < 0 {
+		return fmt.Errorf("max_packet: %d is negative", c.MaxPacket)
+	}
+	if c.ReadBuffer < 0 {
+		return fmt.Errorf("read_buffer: %d is negative", c.ReadBuffer)
+	}
+	if c.WriteBuffer < 0 {
+		return fmt.Errorf("write_buffer: %d is negative", c.WriteBuffer)
+	}
+	if c.DropRate < 0 || c.DropRate > 1 {
+		return fmt.Errorf("drop_rate: %g out of range 0.0-1.0", c.DropRate)
+	}
+	if c.DupRate < 0 || c.DupRate > 1 {
+		return fmt.Errorf("dup_rate: %g out of range 0.0-1.0", c.DupRate)
+	}
+	if c.Delay < 0 {
+		return fmt.Errorf("delay: %s is negative", c.Delay)
+	}
+	if c.Jitter < 0 {
+		return fmt.Errorf("jitter: %s is negative", c.Jitter)
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("idle_timeout: %s is negative", c.IdleTimeout)
+	}
+	if c.MaxLifetime < 0 {
+		return fmt.Errorf("max_lifetime: %s is negative", c.MaxLifetime)
+	}
+	if c.MaxPackets < 0 {
+		return fmt.Errorf("max_packets: %d is negative", c.MaxPackets)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout: %s is negative", c.ShutdownTimeout)
+	}
+	if c.ResolveInterval < 0 {
+		return fmt.Errorf("resolve_interval: %s is negative", c.ResolveInterval)
+	}
+	if c.UpstreamKeepalive < 0 {
+		return fmt.Errorf("upstream_keepalive: %s is negative", c.UpstreamKeepalive)
+	}
+	if c.UpstreamKeepalive > 0 && (c.SingleUpstreamSocket || c.Collapse != "") {
+		return fmt.Errorf("upstream_keepalive: needs a server socket per connection, not single_upstream_socket or collapse")
+	}
+	if c.HealthProbeInterval < 0 {
+		return fmt.Errorf("health_probe_interval: %s is negative", c.HealthProbeInterval)
+	}
+	if c.HealthProbeTimeout < 0 {
+		return fmt.Errorf("health_probe_timeout: %s is negative", c.HealthProbeTimeout)
+	}
+	switch c.RequireUpstream {
+	case "", "udp", "tcp":
+	default:
+		return fmt.Errorf("require_upstream: %q is not udp or tcp", c.RequireUpstream)
+	}
+	if c.RequireUpstream != "" && (c.Echo || c.ServerUnix != "") {
+		return fmt.Errorf("require_upstream: needs UDP servers to check, not echo or server_unix")
+	}
+	if c.RequireUpstreamWait < 0 {
+		return fmt.Errorf("require_upstream_wait: %s is negative", c.RequireUpstreamWait)
+	}
+	if c.StatsInterval < 0 {
+		return fmt.Errorf("stats_interval: %s is negative", c.StatsInterval)
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("write_timeout: %s is negative", c.WriteTimeout)
+	}
+	if c.DialTimeout < 0 {
+		return fmt.Errorf("dial_timeout: %s is negative", c.DialTimeout)
+	}
+	if c.DialCooldown < 0 {
+		return fmt.Errorf("dial_cooldown: %s is negative", c.DialCooldown)
+	}
+	if c.RedialAttempts < 0 {
+		return fmt.Errorf("redial_attempts: %d is negative", c.RedialAttempts)
+	}
+	if c.RedialBackoff < 0 {
+		return fmt.Errorf("redial_backoff: %s is negative", c.RedialBackoff)
+	}
+	if c.FailoverAfter < 0 {
+		return fmt.Errorf("failover_after: %d is negative", c.FailoverAfter)
+	}
+	if _, err := hex.DecodeString(c.RequirePrefix); err != nil {
+		return fmt.Errorf("require_prefix: %v", err)
+	}
+	if c.MinFirstPacket < 0 {
+		return fmt.Errorf("min_first_packet: %d is negative", c.MinFirstPacket)
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("max_connections: %d is negative", c.MaxConnections)
+	}
+	if c.MaxPerSubnet < 0 {
+		return fmt.Errorf("max_per_subnet: %d is negative", c.MaxPerSubnet)
+	}
+	if c.SubnetPrefix < 1 || c.SubnetPrefix > 8*net.IPv4len {
+		return fmt.Errorf("subnet_prefix: %d out of range 1-%d", c.SubnetPrefix, 8*net.IPv4len)
+	}
+	if c.SubnetPrefix6 < 1 || c.SubnetPrefix6 > 8*net.IPv6len {
+		return fmt.Errorf("subnet_prefix6: %d out of range 1-%d", c.SubnetPrefix6, 8*net.IPv6len)
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("rate: %g is negative", c.Rate)
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("burst: %d is negative", c.Burst)
+	}
+	if c.BandwidthServer < 0 {
+		return fmt.Errorf("bandwidth_server: %g is negative", c.BandwidthServer)
+	}
+	if c.BandwidthClient < 0 {
+		return fmt.Errorf("bandwidth_client: %g is negative", c.BandwidthClient)
+	}
+	if c.DSCPServer < 0 || c.DSCPServer > MaxDSCP {
+		return fmt.Errorf("dscp_server: %d is not between 0 and %d", c.DSCPServer, MaxDSCP)
+	}
+	if c.DSCPClient < 0 || c.DSCPClient > MaxDSCP {
+		return fmt.Errorf("dscp_client: %d is not between 0 and %d", c.DSCPClient, MaxDSCP)
+	}
+	if c.TTLServer < 0 || c.TTLServer > MaxTTL {
+		return fmt.Errorf("ttl_server: %d is not between 1 and %d", c.TTLServer, MaxTTL)
+	}
+	if c.McastTTL < 0 || c.McastTTL > MaxTTL {
+		return fmt.Errorf("mcast_ttl: %d is not between 1 and %d", c.McastTTL, MaxTTL)
+	}
+	if c.TTLClient < 0 || c.TTLClient > MaxTTL {
+		return fmt.Errorf("ttl_client: %d is not between 1 and %d", c.TTLClient, MaxTTL)
+	}
+	if c.HexDumpBytes < 0 {
+		return fmt.Errorf("hexdump_bytes: %d is negative", c.HexDumpBytes)
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("log_format: %q is not text or json", c.LogFormat)
+	}
+	if _, err := parseCIDRList(c.Allow); err != nil {
+		return fmt.Errorf("allow: %s", err)
+	}
+	if _, err := parseCIDRList(c.Deny); err != nil {
+		return fmt.Errorf("deny: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,1021 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Information maintained for each client/server connection
+type Connection struct {
+	// Traffic counters, updated atomically. Kept first so they are 64-bit
+	// aligned on 32-bit platforms.
+	c2sBytes, c2sPackets uint64
+	s2cBytes, s2cPackets uint64
+	c2sSeen, s2cSeen     seen
+
+	// With RTTProbe, when the latest datagram was written to the server in
+	// Unix nanoseconds, 0 once a reply has been timed against it, and the
+	// latest round trip estimate. Updated atomically.
+	rttSentAt int64
+	rtt       int64
+
+	// With UpstreamKeepalive, when a datagram last went to the server in
+	// Unix nanoseconds, keepalives included. Updated atomically.
+	lastC2S int64
+
+	// When traffic last passed in either direction, in Unix nanoseconds.
+	// Updated atomically, so relaying a datagram takes no lock to refresh it.
+	lastActivity int64
+
+	// With MaxPackets, datagrams left to relay each way before the
+	// connection closes. Updated atomically.
+	c2sBudget, s2cBudget int64
+
+	ID           uint64         // Number identifying the connection in logs, unique within the proxy
+	Created      time.Time      // Time the connection was created
+	ClientAddr   net.Addr       // Address of the client, guarded by smutex as it changes under KeyByIP
+	ClientConn   net.Conn       // Stream the client is bridged over, nil for UDP clients
+	replyConn    net.PacketConn // Socket the client sends to and is answered on, nil for TCP clients
+	replyOOB     []byte         // Control message choosing the source address of replies, if any
+	ServerAddr   *net.UDPAddr   // Address of the server the client is pinned to, guarded by smutex as it changes on failover
+	ServerConn   *net.UDPConn   // UDP connection to server, guarded by smutex; nil with a single upstream socket
+	ServerUnix   *net.UnixConn  // Unix datagram socket to the ServerUnix server, set once at creation; nil for UDP servers
+	limiter      atomic.Value   // *rate.Limiter of the client packet rate, nil when unlimited; replaced by Reload
+	c2sBandwidth *rate.Limiter  // Byte budget towards the server, nil when unlimited
+	s2cBandwidth *rate.Limiter  // Byte budget towards the client, nil when unlimited
+	c2sDelay     *delayQueue    // Datagrams held back towards the server, nil without a delay
+	s2cDelay     *delayQueue    // Datagrams held back towards the client, nil without a delay
+	key          string         // Client dictionary key
+	metrics      atomic.Value   // *serverMetrics of the server the client is pinned to
+	subnet       string         // Client subnet counted against MaxPerSubnet, empty if not counted
+
+	// Guards ServerConn, which is replaced when the server is redialed,
+	// ServerAddr and ClientAddr, which may change after creation, and
+	// closed, which is set once the connection has been torn down.
+	// Writers to the server hold it for reading across the write, and the
+	// socket is only closed with it held for writing, so the reaper or a
+	// redial waits for writes in flight instead of closing the socket
+	// under them.
+	smutex sync.RWMutex
+	closed bool
+
+	// Consecutive failed reads from the server, used only by runConnection
+	readErrors int
+
+	// Set once the server has been found unreachable, updated atomically
+	refused uint32
+
+	// Datagrams refused by the server since it last answered, updated
+	// atomically
+	refusals uint32
+}
+
+// Generate a new connection by opening a UDP connection to the next server
+func (p *Proxy) newConnection(s *settings, key string, cliAddr net.Addr) *Connection {
+	conn := new(Connection)
+	conn.key = key
+	conn.ClientAddr = cliAddr
+	if !p.config.Echo && p.config.ServerUnix == "" {
+		if conn.ServerAddr = p.restoredServer(s, key); conn.ServerAddr == nil {
+			conn.ServerAddr = p.serverFor(s, cliAddr)
+		}
+	}
+	if p.config.ServerUnix != "" {
+		srvunix, err := p.dialUnixServer()
+		if p.checkreport(LevelError, err) {
+			return nil
+		}
+		conn.ServerUnix = srvunix
+	} else if p.ownSockets() {
+		if p.coolingDown(conn.ServerAddr) {
+			p.Vlogf(LevelTrace, "Refused new client %s, server %s failed recently\n",
+				cliAddr.String(), conn.ServerAddr.String())
+			return nil
+		}
+		srvudp, err := p.dialServer(conn.ServerAddr)
+		if p.checkreport(LevelError, err) {
+			// Running out of local ports is no fault of the server
+			if !errors.Is(err, errNoLocalPort) {
+				p.startCooldown(conn.ServerAddr)
+			}
+			return nil
+		}
+		conn.ServerConn = srvudp
+	}
+	conn.ID = atomic.AddUint64(&p.lastConnID, 1)
+	conn.Created = time.Now()
+	conn.lastActivity = conn.Created.UnixNano()
+	conn.lastC2S = conn.Created.UnixNano()
+	conn.c2sBudget = p.config.MaxPackets
+	conn.s2cBudget = p.config.MaxPackets
+	conn.setRateLimit(s)
+	conn.c2sBandwidth = p.newBandwidth(p.config.BandwidthServer)
+	conn.s2cBandwidth = p.newBandwidth(p.config.BandwidthClient)
+	conn.c2sDelay = p.newDelayQueue(func(due []delayed) { p.sendDelayedToServer(conn, due) })
+	conn.s2cDelay = p.newDelayQueue(func(due []delayed) { p.sendDelayedToClient(conn, due) })
+	return conn
+}
+
+// Report whether a dial to srvAddr failed within the last DialCooldown
+func (p *Proxy) coolingDown(srvAddr *net.UDPAddr) bool {
+	if p.config.DialCooldown <= 0 {
+		return false
+	}
+	p.dfmutex.Lock()
+	defer p.dfmutex.Unlock()
+	until, found := p.dialFailed[srvAddr.String()]
+	if !found {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(p.dialFailed, srvAddr.String())
+		return false
+	}
+	return true
+}
+
+// Refuse new connections to srvAddr for DialCooldown after it failed a dial
+// or a failover away from it
+func (p *Proxy) startCooldown(srvAddr *net.UDPAddr) {
+	if p.config.DialCooldown <= 0 {
+		return
+	}
+	p.dfmutex.Lock()
+	p.dialFailed[srvAddr.String()] = time.Now().Add(p.config.DialCooldown)
+	p.dfmutex.Unlock()
+	p.Vlogf(LevelInfo, "Server %s failed, refusing new clients for it for %s\n",
+		srvAddr.String(), p.config.DialCooldown)
+}
+
+// Token bucket in bytes for a bandwidth of bw bytes/sec, nil if bw is 0.
+// The bucket holds at least a full buffer so any datagram can pass.
+func (p *Proxy) newBandwidth(bw float64) *rate.Limiter {
+	if bw <= 0 {
+		return nil
+	}
+	burst := int(math.Ceil(bw))
+	if burst < p.config.BufferSize {
+		burst = p.config.BufferSize
+	}
+	return rate.NewLimiter(rate.Limit(bw), burst)
+}
+
+// Sleep until bandwidth has budget for n more bytes, or the proxy stops.
+// Datagrams are delayed rather than dropped, so in the client to server
+// direction a throttled UDP client also holds up the shared proxy reader.
+func (p *Proxy) throttle(bandwidth *rate.Limiter, n int) {
+	if bandwidth == nil {
+		return
+	}
+	r := bandwidth.ReserveN(time.Now(), n)
+	if !r.OK() {
+		// Larger than the bucket, e.g. a big PROXY header; let it through
+		return
+	}
+	d := r.Delay()
+	if d == 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-p.ctx.Done():
+	}
+}
+
+// Report whether each connection has its own server socket, read by its
+// own runConnection routine or by the pool
+func (p *Proxy) ownSockets() bool {
+	return p.upstream == nil && !p.config.Echo
+}
+
+// Open a UDP socket connected to srvAddr, giving up after DialTimeout or
+// once the proxy is closed. A multicast group gets an unconnected socket
+// joined to it instead, written with writeServer.
+func (p *Proxy) dialServer(srvAddr *net.UDPAddr) (*net.UDPConn, error) {
+	if srvAddr.IP.IsMulticast() {
+		srvudp, err := p.listenMulticast(srvAddr)
+		if err != nil {
+			return nil, err
+		}
+		return p.tuneServerSocket(srvudp)
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, p.config.DialTimeout)
+	defer cancel()
+	srvudp, err := p.bindLocalPort(func(port int) (*net.UDPConn, error) {
+		var dialer net.Dialer
+		if p.sourceIP != nil || port != 0 {
+			dialer.LocalAddr = &net.UDPAddr{IP: p.sourceIP, Port: port}
+		}
+		c, err := dialer.DialContext(ctx, p.dialNetwork(srvAddr), srvAddr.String())
+		if err != nil {
+			return nil, err
+		}
+		return c.(*net.UDPConn), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.tuneServerSocket(srvudp)
+}
+
+// Apply the DSCP, TTL, DF and buffer settings to a new server socket,
+// closing it on failure
+func (p *Proxy) tuneServerSocket(srvudp *net.UDPConn) (*net.UDPConn, error) {
+	if p.config.DSCPServer != 0 {
+		if err := setDSCP(srvudp, p.config.DSCPServer); err != nil {
+			srvudp.Close()
+			return nil, err
+		}
+	}
+	if p.config.TTLServer != 0 {
+		if err := setTTL(srvudp, p.config.TTLServer); err != nil {
+			srvudp.Close()
+			return nil, err
+		}
+	}
+	if p.config.DFServer {
+		if err := setDF(srvudp); err != nil {
+			srvudp.Close()
+			return nil, err
+		}
+	}
+	if err := p.sizeBuffers(srvudp); err != nil {
+		srvudp.Close()
+		return nil, err
+	}
+	return srvudp, nil
+}
+
+// Current socket to the server
+func (c *Connection) serverConn() *net.UDPConn {
+	c.smutex.RLock()
+	defer c.smutex.RUnlock()
+	return c.ServerConn
+}
+
+// Returned by writeToServer once the connection has been torn down
+var errConnectionClosed = errors.New("connection closed")
+
+// Write a datagram to conn's own server socket, holding smutex so the
+// socket cannot be closed or replaced during the write
+func (p *Proxy) writeToServer(conn *Connection, data []byte) error {
+	conn.smutex.RLock()
+	defer conn.smutex.RUnlock()
+	if conn.closed {
+		return errConnectionClosed
+	}
+	data = p.serverCodec.pack(data)
+	if conn.ServerUnix != nil {
+		p.armWrite(conn.ServerUnix)
+		_, err := conn.ServerUnix.Write(data)
+		return err
+	}
+	p.armWrite(conn.ServerConn)
+	_, err := writeServer(conn.ServerConn, conn.ServerAddr, data)
+	return err
+}
+
+// Replace the socket to the server, closing the old one. Returns false, and
+// closes srvudp instead, if the connection has already been torn down.
+func (c *Connection) setServerConn(srvudp *net.UDPConn) bool {
+	c.smutex.Lock()
+	defer c.smutex.Unlock()
+	if c.closed {
+		srvudp.Close()
+		return false
+	}
+	c.ServerConn.Close()
+	c.ServerConn = srvudp
+	return true
+}
+
+// Latest address of the client
+func (c *Connection) client() net.Addr {
+	c.smutex.RLock()
+	defer c.smutex.RUnlock()
+	return c.ClientAddr
+}
+
+// Time of the latest traffic in either direction
+func (c *Connection) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
+// Latest address of the client as Connections reports it, prefixed with
+// tcp/ for a bridged client
+func (c *Connection) clientName() string {
+	if c.ClientConn != nil {
+		return "tcp/" + c.client().String()
+	}
+	return c.client().String()
+}
+
+// Log fields identifying the connection and its latest client address
+func (c *Connection) fields() Fields {
+	return Fields{Conn: c.ID, Client: c.client().String()}
+}
+
+// Send replies to the client at cliaddr from now on
+func (c *Connection) setClient(cliaddr net.Addr) {
+	c.smutex.Lock()
+	c.ClientAddr = cliaddr
+	c.smutex.Unlock()
+}
+
+// Collectors of the server the connection is currently pinned to
+func (c *Connection) serverMetrics() *serverMetrics {
+	return c.metrics.Load().(*serverMetrics)
+}
+
+// Limiter of the client's packet rate, nil when unlimited
+func (c *Connection) rateLimiter() *rate.Limiter {
+	l, _ := c.limiter.Load().(*rate.Limiter)
+	return l
+}
+
+// Limit the client's packet rate to that of s, keeping the tokens already
+// in its bucket if it had a limit before
+func (c *Connection) setRateLimit(s *settings) {
+	l := c.rateLimiter()
+	switch {
+	case s.rate == 0:
+		l = nil
+	case l == nil:
+		l = rate.NewLimiter(rate.Limit(s.rate), s.burst)
+	default:
+		l.SetLimit(rate.Limit(s.rate))
+		l.SetBurst(s.burst)
+	}
+	c.limiter.Store(l)
+}
+
+// Server the connection is currently pinned to
+func (c *Connection) server() *net.UDPAddr {
+	c.smutex.RLock()
+	defer c.smutex.RUnlock()
+	return c.ServerAddr
+}
+
+// Pin the connection to another server reached over srvudp, closing the
+// old socket. Returns false, and closes srvudp instead, if the connection
+// has already been torn down.
+func (c *Connection) switchServer(srvAddr *net.UDPAddr, srvudp *net.UDPConn, next *serverMetrics) bool {
+	c.smutex.Lock()
+	defer c.smutex.Unlock()
+	if c.closed {
+		srvudp.Close()
+		return false
+	}
+	c.ServerConn.Close()
+	c.ServerConn = srvudp
+	c.ServerAddr = srvAddr
+	// Counted against the new server from now on
+	c.metrics.Store(next)
+	return true
+}
+
+// Close the socket to the server for good
+func (c *Connection) closeServer() {
+	c.smutex.Lock()
+	defer c.smutex.Unlock()
+	c.closed = true
+	if c.ServerConn != nil {
+		c.ServerConn.Close()
+	}
+	if c.ServerUnix != nil {
+		closeUnixServer(c.ServerUnix)
+	}
+}
+
+// Report whether the connection has been torn down
+func (c *Connection) isClosed() bool {
+	c.smutex.RLock()
+	defer c.smutex.RUnlock()
+	return c.closed
+}
+
+// Addresses of conn's server and of the local socket it is reached from,
+// both empty in echo mode
+func (p *Proxy) serverEnds(conn *Connection) (server, local string) {
+	switch {
+	case p.config.Echo:
+		return "", ""
+	case p.upstream != nil:
+		return conn.ServerAddr.String(), p.upstream.conn.LocalAddr().String()
+	case conn.ServerUnix != nil:
+		return p.config.ServerUnix, conn.ServerUnix.LocalAddr().String()
+	}
+	// Not the socket's remote address, which a multicast one lacks
+	return conn.server().String(), conn.serverConn().LocalAddr().String()
+}
+
+// Log the creation of conn, a kind connection such as "TCP ", with the
+// server it is pinned to
+func (p *Proxy) logNewConnection(conn *Connection, kind string, f Fields) {
+	msg := "created " + kind + "connection"
+	f.Conn = conn.ID
+	server, local := p.serverEnds(conn)
+	if server == "" {
+		p.Vlogs(LevelInfo, msg, f, "Created new %sconnection for client %s\n",
+			kind, f.Client)
+		return
+	}
+	f.Server, f.Local = server, local
+	p.Vlogs(LevelInfo, msg, f, "Created new %sconnection for client %s to server %s from %s\n",
+		kind, f.Client, server, local)
+}
+
+// Traffic relayed over a connection
+type Stats struct {
+	C2SBytes, C2SPackets uint64        // Client to server
+	S2CBytes, S2CPackets uint64        // Server to client
+	Duration             time.Duration // Time since the connection was created
+
+	// When the first and latest datagram was relayed each way, zero if none
+	C2SFirst, C2SLast time.Time
+	S2CFirst, S2CLast time.Time
+}
+
+// Snapshot of the traffic relayed so far
+func (c *Connection) Stats() Stats {
+	st := Stats{
+		C2SBytes:   atomic.LoadUint64(&c.c2sBytes),
+		C2SPackets: atomic.LoadUint64(&c.c2sPackets),
+		S2CBytes:   atomic.LoadUint64(&c.s2cBytes),
+		S2CPackets: atomic.LoadUint64(&c.s2cPackets),
+		Duration:   time.Since(c.Created),
+	}
+	st.C2SFirst, st.C2SLast = c.c2sSeen.times()
+	st.S2CFirst, st.S2CLast = c.s2cSeen.times()
+	return st
+}
+
+// When the first and latest datagram was relayed one way, in Unix
+// nanoseconds, 0 until there is one. Updated atomically.
+type seen struct {
+	first, last int64
+}
+
+// Record a datagram relayed now
+func (s *seen) mark() {
+	now := time.Now().UnixNano()
+	atomic.CompareAndSwapInt64(&s.first, 0, now)
+	atomic.StoreInt64(&s.last, now)
+}
+
+func (s *seen) times() (first, last time.Time) {
+	return unixTime(atomic.LoadInt64(&s.first)), unixTime(atomic.LoadInt64(&s.last))
+}
+
+// Time of Unix nanoseconds ns, zero for 0
+func unixTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Pick the next server in weighted round-robin order, passing over servers
+// that failed their health probe unless all have. Safe for concurrent use.
+func (p *Proxy) nextServer(s *settings) *net.UDPAddr {
+	if p.config.HealthProbeInterval == 0 {
+		return p.pickServer(s)
+	}
+	// A full round visits every server at least once
+	tries := len(s.serverAddrs)
+	if s.balancer != nil {
+		tries = s.balancer.total
+	}
+	for i := 0; i < tries; i++ {
+		if srvAddr := p.pickServer(s); p.healthyServer(srvAddr) {
+			return srvAddr
+		}
+	}
+	return p.pickServer(s)
+}
+
+// Server for a new client at cliAddr: its place on the hash ring with
+// Balance "consistent", skipping unhealthy servers, or else the next
+func (p *Proxy) serverFor(s *settings, cliAddr net.Addr) *net.UDPAddr {
+	if s.ring == nil {
+		return p.nextServer(s)
+	}
+	key := cliAddr.String()
+	if udpaddr, ok := cliAddr.(*net.UDPAddr); ok {
+		key = udpaddr.IP.String()
+	}
+	i := s.ring.pick(key, func(i int) bool {
+		return p.config.HealthProbeInterval == 0 || p.healthyServer(s.serverAddrs[i])
+	})
+	return s.serverAddrs[i]
+}
+
+// Take the next server in weighted round-robin order
+func (p *Proxy) pickServer(s *settings) *net.UDPAddr {
+	if len(s.serverAddrs) == 1 {
+		return s.serverAddrs[0]
+	}
+	if s.balancer != nil {
+		return s.serverAddrs[s.balancer.next()]
+	}
+	i := atomic.AddUint32(&p.serverIndex, 1) - 1
+	return s.serverAddrs[i%uint32(len(s.serverAddrs))]
+}
+
+// Network to dial srvAddr on. Unless a stack is forced, pick the family
+// matching the address so v4 and v6 servers both work.
+func (p *Proxy) dialNetwork(srvAddr *net.UDPAddr) string {
+	if p.config.Network != "udp" {
+		return p.config.Network
+	}
+	if srvAddr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// Go routine which manages connection from server to single client
+func (p *Proxy) runConnection(conn *Connection) {
+	defer p.relays.Done()
+	for {
+		bufp := p.bufPool.Get().(*[]byte)
+		ok := p.relayFromServer(conn, *bufp)
+		p.bufPool.Put(bufp)
+		if !ok {
+			return
+		}
+	}
+}
+
+// Start relaying replies from conn's server, on a runConnection routine of
+// its own or through the pool
+func (p *Proxy) readServer(conn *Connection) {
+	if p.pool != nil {
+		p.rearm(conn)
+		return
+	}
+	p.relays.Add(1)
+	go p.runConnection(conn)
+}
+
+// With the pool, arm conn's server socket again, after a read or once it
+// has been replaced. Nothing to do for a runConnection routine, which
+// always reads the latest socket.
+func (p *Proxy) rearm(conn *Connection) {
+	if p.pool == nil {
+		return
+	}
+	if err := p.pool.arm(conn); err != nil && !conn.isClosed() {
+		p.checkreportFields(LevelError, conn.fields(), err)
+	}
+}
+
+// Read one datagram from the server and relay it to the client.
+// Returns false once the connection has been closed.
+func (p *Proxy) relayFromServer(conn *Connection, buffer []byte) bool {
+	// Read from server
+	var n, flags int
+	var err error
+	if conn.ServerUnix != nil {
+		n, _, flags, _, err = conn.ServerUnix.ReadMsgUnix(buffer, nil)
+	} else {
+		n, _, flags, _, err = conn.serverConn().ReadMsgUDP(buffer, nil)
+	}
+	if errors.Is(err, net.ErrClosed) {
+		// Connection has been reaped, unless the socket was replaced by a
+		// failover and the next read goes to the new one
+		return !conn.isClosed()
+	}
+	if err != nil {
+		return p.serverReadError(conn, err)
+	}
+	conn.readErrors = 0
+	atomic.StoreUint32(&conn.refusals, 0)
+	p.relayToClient(conn, buffer, n, flags)
+	return true
+}
+
+// Relay the n byte datagram read into buffer from conn's server to the
+// client, given the flags it was read with
+func (p *Proxy) relayToClient(conn *Connection, buffer []byte, n, flags int) {
+	client := conn.client().String()
+	fields := Fields{Conn: conn.ID, Client: client, Bytes: n, area: areaConn}
+	p.rttReceived(conn, fields)
+	if flags&msgTrunc != 0 {
+		p.warnTruncated(true)
+		p.countDrop(dropOversize)
+		p.Vlogs(LevelInfo, "dropped truncated datagram from server", fields,
+			"Dropped datagram from server to %s larger than the %d byte buffer\n",
+			client, len(buffer))
+		return
+	}
+	if !haveMsgTrunc && n == len(buffer) {
+		p.warnTruncated(false)
+		p.Vlogs(LevelInfo, "datagram from server may be truncated", fields,
+			"Warning: datagram from server to %s filled the %d byte buffer and may be truncated\n",
+			client, n)
+	}
+	data, bufp := p.unpackFrom(p.serverCodec, "server", buffer[0:n], fields)
+	if data == nil {
+		return
+	}
+	defer p.serverCodec.release(bufp)
+	atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
+	p.forwardToClient(conn, data, fields)
+}
+
+// Apply the drop rate and transformer to a datagram from conn's server and,
+// if it survives them, write it to the client
+func (p *Proxy) forwardToClient(conn *Connection, data []byte, fields Fields) {
+	client := fields.Client
+	s := p.current()
+	if p.dropPacket(s) {
+		p.countDrop(dropPolicy)
+		p.Vlogs(LevelVerbose, "dropped packet from server", fields,
+			"Dropped packet from server to %s\n", client)
+		return
+	}
+	p.logChecksum(fields, "from server, before transform", data)
+	if data = p.transformer.ServerToClient(data); data == nil {
+		p.countDrop(dropPolicy)
+		p.Vlogs(LevelVerbose, "transformer dropped packet from server", fields,
+			"Transformer dropped packet from server to %s\n", client)
+		return
+	}
+	p.logChecksum(fields, "to client, after transform", data)
+	copies := 1
+	if p.dupPacket(s) {
+		copies = 2
+		p.Vlogs(LevelTrace, "duplicated packet from server", fields,
+			"Duplicated packet from server to %s\n", client)
+	}
+	for i := 0; i < copies; i++ {
+		p.throttle(conn.s2cBandwidth, len(data))
+		if conn.s2cDelay != nil {
+			p.delay(conn.s2cDelay, data, 0, fields)
+			continue
+		}
+		p.sendToClient(conn, data, fields)
+	}
+}
+
+// Write a datagram from conn's server to its client
+func (p *Proxy) sendToClient(conn *Connection, data []byte, fields Fields) {
+	// Relay it to client
+	err := p.writeToClient(conn, data)
+	p.sentToClient(conn, data, fields, err)
+}
+
+// Send datagrams released by conn's delay queue towards the client, in one
+// batch where the platform and configuration allow
+func (p *Proxy) sendDelayedToClient(conn *Connection, due []delayed) {
+	_, udp := conn.replyConn.(*net.UDPConn)
+	if haveBatch && p.config.Batch > 1 && len(due) > 1 && udp && conn.ClientConn == nil {
+		errs := p.writeBatchToClient(conn, due)
+		for i, d := range due {
+			p.sentToClient(conn, d.data, d.fields, errs[i])
+		}
+		return
+	}
+	for _, d := range due {
+		p.sendToClient(conn, d.data, d.fields)
+	}
+}
+
+// Account for a datagram written to conn's client with result err
+func (p *Proxy) sentToClient(conn *Connection, data []byte, fields Fields, err error) {
+	client := fields.Client
+	if errors.Is(err, syscall.EMSGSIZE) {
+		// Over the path MTU with DFClient, or grown past the UDP limit by
+		// the transformer or PSK. The proxy socket is not connected, so the
+		// kernel keeps no MTU for it.
+		size := len(data)
+		if p.psk != nil {
+			size += p.psk.overhead()
+		}
+		p.countDrop(dropMsgSize)
+		p.checkreportFields(LevelError, fields, mtuError("server", "client "+client, size, 0))
+		return
+	}
+	if isTimeout(err) {
+		p.Vlogs(LevelVerbose, "write to client timed out", fields,
+			"Dropped packet from server to %s, write timed out\n", client)
+		return
+	}
+	if p.checkreportFields(LevelError, fields, err) {
+		return
+	}
+	p.countS2C(conn, len(data))
+	p.capture(conn.server(), conn.client(), data)
+	if p.logs(LevelDebug, fields.area) {
+		p.Vlogs(LevelDebug, "relayed to client", fields, "Relayed %s from server to %s.\n",
+			p.payload(data), client)
+	}
+	p.dumpPayload(fields, data)
+}
+
+// Consecutive transient read errors after which the server is redialed
+const maxTransientErrors = 10
+
+// Report whether err is a deadline expiring
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// Report whether a read error from a server socket means the socket is no
+// longer usable. Timeouts clear up by themselves.
+func fatalReadError(err error) bool {
+	return !isTimeout(err)
+}
+
+// Arm the write deadline on c when a write timeout is configured
+func (p *Proxy) armWrite(c net.PacketConn) {
+	if p.config.WriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(p.config.WriteTimeout))
+	}
+}
+
+// Handle a failed read from conn's server. A refusal, which is how an ICMP
+// port unreachable surfaces on a connected socket, tears the connection down
+// at once. Other transient errors are logged and the read retried. Fatal
+// errors, or transient ones that persist, make the server be redialed, and
+// the connection is torn down if that fails too. Returns false once the
+// connection is gone.
+func (p *Proxy) serverReadError(conn *Connection, err error) bool {
+	p.checkreportFields(LevelError, conn.fields(), err)
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return p.serverRefused(conn)
+	}
+	conn.readErrors++
+	if !fatalReadError(err) && conn.readErrors < maxTransientErrors {
+		return true
+	}
+	if p.redial(conn) {
+		conn.readErrors = 0
+		return true
+	}
+	fields := conn.fields()
+	p.Vlogs(LevelInfo, "giving up on server", fields,
+		"Giving up on server %s for client %s\n", conn.server().String(), fields.Client)
+	p.dropConnection(conn)
+	return false
+}
+
+// Redial conn's server, waiting RedialBackoff before the first attempt and
+// doubling the wait after each failure. Returns true once a new socket is
+// in place.
+func (p *Proxy) redial(conn *Connection) bool {
+	if conn.ServerUnix != nil {
+		// The client's next datagram gets a new connection instead
+		return false
+	}
+	backoff := p.config.RedialBackoff
+	for attempt := 1; attempt <= p.config.RedialAttempts; attempt++ {
+		select {
+		case <-p.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		srvudp, err := p.dialServer(conn.server())
+		if p.checkreportFields(LevelError, conn.fields(), err) {
+			continue
+		}
+		if !conn.setServerConn(srvudp) {
+			return false
+		}
+		p.rearm(conn)
+		fields := conn.fields()
+		p.Vlogs(LevelInfo, "redialed server", fields,
+			"Redialed server %s for client %s on attempt %d\n",
+			conn.server().String(), fields.Client, attempt)
+		return true
+	}
+	return false
+}
+
+// Handle a datagram refused by conn's server. With FailoverAfter set and
+// several servers, conn moves to another server once that many datagrams
+// in a row have been refused; otherwise, or if no other server can be
+// dialed, conn is torn down. Returns false once conn has been torn down.
+func (p *Proxy) serverRefused(conn *Connection) bool {
+	after := uint32(p.config.FailoverAfter)
+	if after == 0 || !p.ownSockets() || len(p.current().serverAddrs) < 2 {
+		p.serverUnreachable(conn)
+		return false
+	}
+	// Only the caller reaching the threshold fails over, so the reader and
+	// writer cannot both do it
+	if n := atomic.AddUint32(&conn.refusals, 1); n != after {
+		return n < after || !conn.isClosed()
+	}
+	if !p.failover(conn) {
+		p.serverUnreachable(conn)
+		return false
+	}
+	atomic.StoreUint32(&conn.refusals, 0)
+	return true
+}
+
+// Move conn to a server other than its current one, skipping servers in
+// their dial cooldown. The old server is put in cooldown. Returns false if
+// no other server could be dialed or conn has been torn down.
+func (p *Proxy) failover(conn *Connection) bool {
+	s := p.current()
+	old := conn.server()
+	p.startCooldown(old)
+	for range s.serverAddrs {
+		srvAddr := p.nextServer(s)
+		if srvAddr.String() == old.String() || p.coolingDown(srvAddr) {
+			continue
+		}
+		srvudp, err := p.dialServer(srvAddr)
+		if p.checkreportFields(LevelError, conn.fields(), err) {
+			p.startCooldown(srvAddr)
+			continue
+		}
+		prev := conn.serverMetrics()
+		next := p.attachMetrics(p.serverLabel(s, srvAddr))
+		if !conn.switchServer(srvAddr, srvudp, next) {
+			p.detachMetrics(next)
+			return false
+		}
+		p.detachMetrics(prev)
+		p.rearm(conn)
+		fields := conn.fields()
+		fields.Server = srvAddr.String()
+		p.Vlogs(LevelInfo, "failed over", fields,
+			"Failed over client %s from server %s to %s\n", fields.Client, old.String(), srvAddr.String())
+		return true
+	}
+	return false
+}
+
+// Tear down conn after its server refused a datagram, first sending the
+// client the configured unreachable reply, if any. The next datagram from
+// the client dials the server afresh.
+func (p *Proxy) serverUnreachable(conn *Connection) {
+	if !atomic.CompareAndSwapUint32(&conn.refused, 0, 1) {
+		return
+	}
+	fields := conn.fields()
+	p.Vlogs(LevelInfo, "upstream unreachable", fields,
+		"Upstream %s unreachable for client %s, closing connection\n",
+		conn.server().String(), fields.Client)
+	if reply := p.config.UnreachableReply; reply != "" {
+		err := p.writeToClient(conn, []byte(reply))
+		p.checkreportFields(LevelError, fields, err)
+	}
+	p.dropConnection(conn)
+}
+
+// Remove conn from the dictionary unless the reaper or Close already has
+func (p *Proxy) dropConnection(conn *Connection) {
+	shard := p.clientDict.shard(conn.key)
+	shard.dlock()
+	if shard.conns[conn.key] == conn {
+		p.removeConnection(shard, conn.key, conn)
+	}
+	shard.dunlock()
+}
+
+// Take a relayed datagram out of budget, conn's budget for its direction,
+// closing conn once that and its other budget are both spent. The client's
+// next datagram opens a new connection.
+func (p *Proxy) spendPacket(conn *Connection, budget, other *int64) {
+	if p.config.MaxPackets == 0 {
+		return
+	}
+	if atomic.AddInt64(budget, -1) != 0 || atomic.LoadInt64(other) > 0 {
+		return
+	}
+	shard := p.clientDict.shard(conn.key)
+	shard.dlock()
+	if shard.conns[conn.key] == conn {
+		p.removeConnection(shard, conn.key, conn)
+		// Under KeyByIP the key is not the client's address
+		fields := conn.fields()
+		p.Vlogs(LevelVerbose, "expired connection", fields,
+			"Closed connection for client %s after %d packets each way\n", fields.Client, p.config.MaxPackets)
+	}
+	shard.dunlock()
+}
+
+// Send a datagram to conn's client, framed if the client came in over TCP
+// and encrypted if PSK is set
+func (p *Proxy) writeToClient(conn *Connection, data []byte) error {
+	data = p.clientCodec.pack(data)
+	if p.psk != nil {
+		sealed, err := p.psk.seal(data)
+		if err != nil {
+			return err
+		}
+		data = sealed
+	}
+	if conn.ClientConn != nil {
+		return writeFrame(conn.ClientConn, data)
+	}
+	p.armWrite(conn.replyConn)
+	if conn.replyOOB != nil {
+		_, _, err := conn.replyConn.(*net.UDPConn).WriteMsgUDP(data, conn.replyOOB, conn.client().(*net.UDPAddr))
+		return err
+	}
+	_, err := conn.replyConn.WriteTo(data, conn.client())
+	return err
+}
+
+// Go routine which closes connections that have seen no traffic for idle,
+// or have been open for lifetime however busy; a zero duration disables
+// that check. A recycled UDP client gets a new connection, and possibly
+// another server, with its next datagram. Each shard is scanned under its
+// dmutex, so the reaper cannot race with runProxy creating or refreshing a
+// connection for the same client. Replies refresh LastActivity without it.
+func (p *Proxy) runReaper(idle, lifetime time.Duration) {
+	defer p.relays.Done()
+	interval := idle / 2
+	if lifetime > 0 && (idle == 0 || lifetime < idle) {
+		interval = lifetime / 2
+	}
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		p.clientDict.each(func(s *dictShard, saddr string, conn *Connection) {
+			if lifetime > 0 && now.Sub(conn.Created) >= lifetime {
+				fields := conn.fields()
+				p.removeConnection(s, saddr, conn)
+				p.Vlogs(LevelInfo, "recycled connection", fields,
+					"Recycled connection for client %s after its %s lifetime\n", fields.Client, lifetime)
+				return
+			}
+			if idle == 0 || now.Sub(conn.LastActivity()) < idle {
+				return
+			}
+			// Dropping the entry also releases its rate limiter
+			fields := conn.fields()
+			p.removeConnection(s, saddr, conn)
+			p.Vlogs(LevelInfo, "closed idle connection", fields,
+				"Closed idle connection for client %s\n", fields.Client)
+		})
+	}
+}
+
+// Remove conn from the dictionary and close its server socket, which makes
+// runConnection return. Caller must hold the dmutex of shard s.
+func (p *Proxy) removeConnection(s *dictShard, saddr string, conn *Connection) {
+	delete(s.conns, saddr)
+	atomic.AddInt64(&p.connCount, -1)
+	p.releaseSubnet(conn.subnet)
+	// Closed first, so a failover can no longer move conn to other metrics
+	conn.closeServer()
+	p.detachMetrics(conn.serverMetrics())
+	if p.pool != nil {
+		p.pool.forget(conn)
+	}
+	if conn.ClientConn != nil {
+		conn.ClientConn.Close()
+	}
+	if p.config.OnDisconnect != nil {
+		s.removed = append(s.removed, conn)
+	}
+	fields := conn.fields()
+	if n := conn.c2sDelay.close() + conn.s2cDelay.close(); n > 0 {
+		p.Vlogs(LevelVerbose, "discarded delayed packets", fields,
+			"Discarded %d delayed packets for client %s\n", n, fields.Client)
+	}
+	st := conn.Stats()
+	fields.Session = &st
+	p.Vlogs(LevelInfo, "connection closed", fields,
+		"Connection for client %s closed after %s: client to server %d bytes in %d packets%s, server to client %d bytes in %d packets%s\n",
+		fields.Client, st.Duration.Round(time.Millisecond),
+		st.C2SBytes, st.C2SPackets, seenText(st.C2SFirst, st.C2SLast),
+		st.S2CBytes, st.S2CPackets, seenText(st.S2CFirst, st.S2CLast))
+}
+
+// Timestamps of a direction's first and last datagram as shown in the
+// teardown line, empty if it had none
+func seenText(first, last time.Time) string {
+	if first.IsZero() {
+		return ""
+	}
+	return " from " + first.Format(seenFormat) + " to " + last.Format(seenFormat)
+}
@@ -0,0 +1,162 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/annlumia/udp-proxy/proxy"
+	"github.com/annlumia/udp-proxy/proxy/proxytest"
+)
+
+// Wait up to proxytest.DefaultTimeout for done to report true
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(proxytest.DefaultTimeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Address of a loopback UDP port nothing listens on
+func closedPort(t *testing.T) string {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := c.LocalAddr().String()
+	c.Close()
+	return addr
+}
+
+// A server port that refuses datagrams tears the connection down, telling
+// the client with UnreachableReply when it is set
+func TestUnreachableServer(t *testing.T) {
+	for _, reply := range []string{"", "unreachable"} {
+		t.Run("reply="+reply, func(t *testing.T) {
+			env, err := proxytest.New(proxy.Config{
+				Servers:          []string{closedPort(t)},
+				UnreachableReply: reply,
+			}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer env.Close()
+			env.Timeout = 200 * time.Millisecond
+
+			got, err := env.RoundTrip(env.Client, []byte("ping"))
+			if reply == "" {
+				if err == nil {
+					t.Fatalf("got %q from a closed server port, want no reply", got)
+				}
+			} else if err != nil || string(got) != reply {
+				t.Fatalf("got %q, %v, want %q", got, err, reply)
+			}
+			if sent := env.Proxy.Totals().C2SPackets; sent != 1 {
+				t.Fatalf("%d datagrams relayed to the server, want 1", sent)
+			}
+			waitFor(t, "the connection to be torn down", func() bool {
+				return len(env.Proxy.Connections()) == 0
+			})
+		})
+	}
+}
+
+// Logger keeping every line, for tests that look for one
+type lineLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *lineLogger) Printf(format string, v ...interface{}) {
+	l.mutex.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+	l.mutex.Unlock()
+}
+
+// Lines logged so far containing all of parts
+func (l *lineLogger) matching(parts ...string) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var found []string
+next:
+	for _, line := range l.lines {
+		for _, part := range parts {
+			if !strings.Contains(line, part) {
+				continue next
+			}
+		}
+		found = append(found, line)
+	}
+	return found
+}
+
+// Transformer growing every reply to size bytes
+type growReplies struct{ size int }
+
+func (growReplies) ClientToServer(data []byte) []byte { return data }
+func (g growReplies) ServerToClient(data []byte) []byte {
+	return make([]byte, g.size)
+}
+
+// A reply the kernel refuses as too large is logged with its size and
+// counted apart from other write errors
+func TestOversizedReply(t *testing.T) {
+	const size = proxy.MaxUDPPayload + 100
+	logger := new(lineLogger)
+	env, err := proxytest.New(proxy.Config{
+		Verbosity:   proxy.LevelError,
+		Logger:      logger,
+		Transformer: growReplies{size},
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	env.Timeout = 200 * time.Millisecond
+
+	if got, err := env.RoundTrip(env.Client, []byte("ping")); err == nil {
+		t.Fatalf("got a %d byte reply, want none", len(got))
+	}
+	waitFor(t, "the reply to be dropped", func() bool {
+		return env.Proxy.Dropped("msgsize") == 1
+	})
+	want := fmt.Sprintf("dropped %d byte packet from server to client %s", size, env.Client.LocalAddr())
+	if lines := logger.matching(want, "UDP payload limit"); len(lines) != 1 {
+		t.Fatalf("logged %q, want one line with %q", logger.matching("Error"), want)
+	}
+	if n := env.Proxy.Totals().S2CPackets; n != 0 {
+		t.Fatalf("%d replies counted as relayed, want 0", n)
+	}
+}
+
+// Under KeyByIP a connection is keyed by the bare IP, yet it is listed and
+// closed by the client's address
+func TestConnectionClientAddress(t *testing.T) {
+	env, err := proxytest.New(proxy.Config{KeyByIP: true}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	if _, err := env.RoundTrip(env.Client, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	client := env.Client.LocalAddr().String()
+	conns := env.Proxy.Connections()
+	if len(conns) != 1 || conns[0].Client != client {
+		t.Fatalf("connections %+v, want one for client %s", conns, client)
+	}
+	if !env.Proxy.CloseConnection(client) {
+		t.Fatalf("no connection closed for client %s", client)
+	}
+	if n := len(env.Proxy.Connections()); n != 0 {
+		t.Fatalf("%d connections left, want 0", n)
+	}
+}
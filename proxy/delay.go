@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Datagrams of one direction of a connection held back by Delay and Jitter.
+// A single timer fires at the earliest release time and hands everything
+// due by then to send at once, so it can go out in one batch.
+type delayQueue struct {
+	send   func(due []delayed)
+	mutex  sync.Mutex
+	smutex sync.Mutex // Held while sending, so due datagrams leave in order
+	timer  *time.Timer
+	items  []delayed // Sorted by release time
+	last   time.Time // Latest release time queued
+	closed bool
+}
+
+// A datagram waiting in a delayQueue
+type delayed struct {
+	at     time.Time
+	data   []byte
+	skip   int // Bytes of data ahead of the payload, a PROXY header
+	fields Fields
+}
+
+// Queue for one direction of a new connection, nil when no delay is set
+func (p *Proxy) newDelayQueue(send func(due []delayed)) *delayQueue {
+	if p.config.Delay == 0 && p.config.Jitter == 0 {
+		return nil
+	}
+	return &delayQueue{send: send}
+}
+
+// Hold a copy of data in q for Delay plus up to Jitter. Unless Reorder is
+// set a datagram never overtakes one queued before it.
+func (p *Proxy) delay(q *delayQueue, data []byte, skip int, fields Fields) {
+	d := p.config.Delay
+	if p.config.Jitter > 0 {
+		p.drmutex.Lock()
+		d += time.Duration(p.dropRand.Int63n(int64(p.config.Jitter)))
+		p.drmutex.Unlock()
+	}
+	// The read buffer is reused before the datagram goes out
+	item := delayed{data: append([]byte(nil), data...), skip: skip, fields: fields}
+	q.push(time.Now().Add(d), !p.config.Reorder, item)
+}
+
+func (q *delayQueue) push(at time.Time, keepOrder bool, item delayed) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+	if keepOrder && at.Before(q.last) {
+		at = q.last
+	}
+	if at.After(q.last) {
+		q.last = at
+	}
+	// After any datagram released at the same time, so those keep order
+	i := sort.Search(len(q.items), func(i int) bool { return q.items[i].at.After(at) })
+	q.items = append(q.items, delayed{})
+	copy(q.items[i+1:], q.items[i:])
+	item.at = at
+	q.items[i] = item
+	if i > 0 {
+		return
+	}
+	if q.timer == nil {
+		q.timer = time.AfterFunc(time.Until(at), q.flush)
+	} else {
+		q.timer.Reset(time.Until(at))
+	}
+}
+
+// Send the datagrams that are due and rearm the timer for the rest
+func (q *delayQueue) flush() {
+	q.smutex.Lock()
+	defer q.smutex.Unlock()
+	q.mutex.Lock()
+	now := time.Now()
+	n := 0
+	for n < len(q.items) && !q.items[n].at.After(now) {
+		n++
+	}
+	due := q.items[:n:n]
+	q.items = q.items[n:]
+	if len(q.items) > 0 {
+		q.timer.Reset(time.Until(q.items[0].at))
+	}
+	q.mutex.Unlock()
+	if len(due) > 0 {
+		q.send(due)
+	}
+}
+
+// Discard the datagrams still waiting and refuse new ones. Returns the
+// number discarded.
+func (q *delayQueue) close() int {
+	if q == nil {
+		return 0
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	n := len(q.items)
+	q.items = nil
+	return n
+}
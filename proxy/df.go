@@ -0,0 +1,15 @@
+package proxy
+
+import "fmt"
+
+// Error for a datagram of n bytes from src that could not be sent to dst
+// without fragmenting, with the path MTU if the kernel knows it
+func mtuError(src, dst string, n, mtu int) error {
+	if n > MaxUDPPayload {
+		return fmt.Errorf("dropped %d byte packet from %s to %s: larger than the %d byte UDP payload limit", n, src, dst, MaxUDPPayload)
+	}
+	if mtu > 0 {
+		return fmt.Errorf("dropped %d byte packet from %s to %s: larger than the path MTU of %d bytes", n, src, dst, mtu)
+	}
+	return fmt.Errorf("dropped %d byte packet from %s to %s: larger than the path MTU", n, src, dst)
+}
@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set the Don't Fragment bit on datagrams sent on c, so one too large for
+// the path fails with EMSGSIZE instead of being fragmented. As with setTTL,
+// a dual-stack socket gets both, the IPv4 one on a best effort basis.
+func setDF(c *net.UDPConn) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	laddr := c.LocalAddr().(*net.UDPAddr)
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if laddr.IP.To4() != nil {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+			return
+		}
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+		if serr == nil && laddr.IP.IsUnspecified() {
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// Path MTU the kernel has learned for the peer of connected socket c, 0 if
+// unknown
+func pathMTU(c *net.UDPConn) int {
+	raddr, _ := c.RemoteAddr().(*net.UDPAddr)
+	if raddr == nil {
+		return 0
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	mtu := 0
+	rc.Control(func(fd uintptr) {
+		if raddr.IP.To4() != nil {
+			mtu, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU)
+		} else {
+			mtu, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU)
+		}
+	})
+	if err != nil {
+		return 0
+	}
+	return mtu
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// The Don't Fragment bit is only set on Linux
+func setDF(c *net.UDPConn) error {
+	return errors.New("setting don't fragment is only supported on Linux")
+}
+
+func pathMTU(c *net.UDPConn) int { return 0 }
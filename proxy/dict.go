@@ -0,0 +1,86 @@
+package proxy
+
+import "sync"
+
+// Number of shards the client dictionary is split into
+const dictShards = 64
+
+// One shard of the client dictionary: a mapping from client addresses (as
+// host:port) to connection, and the mutex used to serialize access to it
+type dictShard struct {
+	dmutex sync.Mutex
+	conns  map[string]*Connection
+
+	// Keys whose connection is being created with dmutex released, each
+	// with a channel closed once it is in conns or has failed
+	dialing map[string]chan struct{}
+
+	// Connections removed while dmutex was held, handed to onRemove by
+	// dunlock so callbacks never run with the shard locked
+	removed  []*Connection
+	onRemove func(conn *Connection)
+}
+
+func (s *dictShard) dlock() {
+	s.dmutex.Lock()
+}
+
+func (s *dictShard) dunlock() {
+	removed := s.removed
+	s.removed = nil
+	s.dmutex.Unlock()
+	for _, conn := range removed {
+		s.onRemove(conn)
+	}
+}
+
+// Wait until no connection for key is being created. Caller must hold
+// dmutex, which is released while waiting.
+func (s *dictShard) awaitDial(key string) {
+	for done := s.dialing[key]; done != nil; done = s.dialing[key] {
+		s.dunlock()
+		<-done
+		s.dlock()
+	}
+}
+
+// The client dictionary, sharded by a hash of the client address so that
+// packets from different clients rarely contend for the same lock
+type clientDict struct {
+	shards [dictShards]dictShard
+}
+
+// New dictionary calling onRemove, outside the shard lock, for each
+// connection removed from it
+func newClientDict(onRemove func(conn *Connection)) *clientDict {
+	d := new(clientDict)
+	for i := range d.shards {
+		d.shards[i].conns = make(map[string]*Connection)
+		d.shards[i].dialing = make(map[string]chan struct{})
+		d.shards[i].onRemove = onRemove
+	}
+	return d
+}
+
+// Shard holding key, chosen by 32-bit FNV-1a
+func (d *clientDict) shard(key string) *dictShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &d.shards[h%dictShards]
+}
+
+// Call f for every connection. Each shard is locked while its entries are
+// visited, and f may delete the entry it is given.
+func (d *clientDict) each(f func(s *dictShard, saddr string, conn *Connection)) {
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.dlock()
+		for saddr, conn := range s.conns {
+			f(s, saddr, conn)
+		}
+		s.dunlock()
+	}
+}
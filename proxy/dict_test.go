@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Number of client addresses the dictionary benchmarks look up
+const benchClients = 4096
+
+func benchKeys() []string {
+	keys := make([]string, benchClients)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.%d.%d.%d:%d", i>>16&255, i>>8&255, i&255, 1024+i)
+	}
+	return keys
+}
+
+// Lookups from many routines at once in the sharded client dictionary
+func BenchmarkDictSharded(b *testing.B) {
+	keys := benchKeys()
+	d := newClientDict(func(*Connection) {})
+	for _, key := range keys {
+		d.shard(key).conns[key] = &Connection{key: key}
+	}
+	var next uint32
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddUint32(&next, 1) * 7919
+		for pb.Next() {
+			key := keys[i%benchClients]
+			s := d.shard(key)
+			s.dlock()
+			conn := s.conns[key]
+			s.dunlock()
+			if conn == nil {
+				b.Errorf("no connection for %s", key)
+				return
+			}
+			i++
+		}
+	})
+}
+
+// The same lookups in one map behind a single mutex, as before sharding
+func BenchmarkDictSingleLock(b *testing.B) {
+	keys := benchKeys()
+	var dmutex sync.Mutex
+	conns := make(map[string]*Connection)
+	for _, key := range keys {
+		conns[key] = &Connection{key: key}
+	}
+	var next uint32
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddUint32(&next, 1) * 7919
+		for pb.Next() {
+			key := keys[i%benchClients]
+			dmutex.Lock()
+			conn := conns[key]
+			dmutex.Unlock()
+			if conn == nil {
+				b.Errorf("no connection for %s", key)
+				return
+			}
+			i++
+		}
+	})
+}
+
+// A lookup of a key being dialed waits for the dial with the shard unlocked,
+// so other keys of the shard stay reachable meanwhile
+func TestAwaitDial(t *testing.T) {
+	d := newClientDict(func(*Connection) {})
+	s := d.shard("a")
+	done := make(chan struct{})
+	s.dialing["a"] = done
+
+	found := make(chan *Connection)
+	go func() {
+		s.dlock()
+		s.awaitDial("a")
+		conn := s.conns["a"]
+		s.dunlock()
+		found <- conn
+	}()
+
+	// Inserting under the lock proves the waiter released it
+	s.dlock()
+	conn := &Connection{key: "a"}
+	s.conns["a"] = conn
+	delete(s.dialing, "a")
+	close(done)
+	s.dunlock()
+	if got := <-found; got != conn {
+		t.Fatalf("waiter found %v, want the dialed connection", got)
+	}
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import "sync/atomic"
+
+// Stop or resume accepting new clients. While draining, datagrams from
+// clients without a connection are dropped and Ready reports false, but
+// existing connections are served until they idle out or are closed.
+func (p *Proxy) SetDraining(on bool) {
+	var v uint32
+	if on {
+		v = 1
+	}
+	if atomic.SwapUint32(&p.draining, v) == v {
+		return
+	}
+	if on {
+		p.Vlogf(LevelInfo, "Draining, refusing new clients\n")
+	} else {
+		p.Vlogf(LevelInfo, "No longer draining, accepting new clients\n")
+	}
+}
+
+// Report whether the proxy is refusing new clients
+func (p *Proxy) Draining() bool {
+	return atomic.LoadUint32(&p.draining) == 1
+}
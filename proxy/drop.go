@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Seed the drop random source. A seed of 0 uses the current time.
+func (p *Proxy) setupDrop() {
+	seed := p.config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	p.dropRand = rand.New(rand.NewSource(seed))
+}
+
+// Decide whether to drop a datagram. A zero rate never touches the RNG.
+func (p *Proxy) dropPacket(s *settings) bool {
+	return p.chance(s.dropRate)
+}
+
+// Decide whether to send a datagram twice. A zero rate never touches the
+// RNG.
+func (p *Proxy) dupPacket(s *settings) bool {
+	return p.chance(s.dupRate)
+}
+
+// Report true with probability rate
+func (p *Proxy) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	p.drmutex.Lock()
+	r := p.dropRand.Float64()
+	p.drmutex.Unlock()
+	return r < rate
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Largest DSCP codepoint, which fills the upper six bits of the ToS byte
+const MaxDSCP = 63
+
+// Mark datagrams sent on c with DSCP codepoint dscp. A dual-stack socket
+// sends both families, so both the IPv6 traffic class and the IPv4 ToS are
+// set on it; for IPv4-mapped traffic only the latter may be supported.
+func setDSCP(c *net.UDPConn, dscp int) error {
+	tos := dscp << 2
+	laddr := c.LocalAddr().(*net.UDPAddr)
+	if laddr.IP.To4() != nil {
+		return ipv4.NewConn(c).SetTOS(tos)
+	}
+	if err := ipv6.NewConn(c).SetTrafficClass(tos); err != nil {
+		return err
+	}
+	if laddr.IP.IsUnspecified() {
+		ipv4.NewConn(c).SetTOS(tos)
+	}
+	return nil
+}
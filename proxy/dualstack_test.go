@@ -0,0 +1,68 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/annlumia/udp-proxy/proxy"
+	"github.com/annlumia/udp-proxy/proxy/proxytest"
+)
+
+// Send data from c to addr and wait for the reply
+func exchange(t *testing.T, c *net.UDPConn, addr *net.UDPAddr, data string) {
+	t.Helper()
+	if _, err := c.WriteToUDP([]byte(data), addr); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(proxytest.DefaultTimeout))
+	buffer := make([]byte, 64)
+	n, _, err := c.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatalf("no reply to %s from %s: %v", c.LocalAddr(), addr, err)
+	}
+	if string(buffer[:n]) != data {
+		t.Fatalf("got %q, want %q", buffer[:n], data)
+	}
+}
+
+// An IPv4 and an IPv6 client on the same port number each get their own
+// connection from a proxy listening on both stacks
+func TestDualStackClients(t *testing.T) {
+	server, err := proxytest.NewEchoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	p := proxy.New(proxy.Config{Servers: []string{server.Addr()}})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	port := p.Addr().(*net.UDPAddr).Port
+
+	v4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v4.Close()
+	cliPort := v4.LocalAddr().(*net.UDPAddr).Port
+	v6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback, Port: cliPort})
+	if err != nil {
+		t.Skipf("no IPv6 loopback on port %d: %v", cliPort, err)
+	}
+	defer v6.Close()
+
+	exchange(t, v4, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, "four")
+	exchange(t, v6, &net.UDPAddr{IP: net.IPv6loopback, Port: port}, "six")
+
+	clients := make(map[string]bool)
+	for _, info := range p.Connections() {
+		clients[info.Client] = true
+	}
+	want := []string{v4.LocalAddr().String(), v6.LocalAddr().String()}
+	if len(clients) != 2 || !clients[want[0]] || !clients[want[1]] {
+		t.Fatalf("connections for %v, want one each for %v", clients, want)
+	}
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import "net"
+
+// Call OnConnect, if set, for a connection just added to the dictionary.
+// Callers must not hold any dmutex.
+func (p *Proxy) connected(conn *Connection) {
+	if p.config.OnConnect == nil {
+		return
+	}
+	var server net.Addr
+	if srvAddr := conn.server(); srvAddr != nil {
+		server = srvAddr
+	}
+	p.config.OnConnect(conn.client(), server)
+}
+
+// Call OnDisconnect, if set, for a connection removed from the dictionary.
+// Run by dunlock once the shard is unlocked.
+func (p *Proxy) disconnected(conn *Connection) {
+	p.config.OnDisconnect(conn.client(), conn.Stats())
+}
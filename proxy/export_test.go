@@ -0,0 +1,12 @@
+package proxy
+
+// Datagrams dropped since Start for reason, named as in the metrics
+func (p *Proxy) Dropped(reason string) uint64 {
+	drops := p.droppedTotals()
+	for i, name := range dropNames {
+		if name == reason {
+			return drops[i]
+		}
+	}
+	return 0
+}
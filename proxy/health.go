@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Go routine which probes every server each interval, taking those that
+// fail out of the pool new connections are spread over until they pass
+// again. Existing connections keep their server.
+func (p *Proxy) runHealthProbe(interval time.Duration) {
+	defer p.relays.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.probeServers(p.current().serverAddrs)
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Probe the servers at once and record which are healthy, logging changes
+func (p *Proxy) probeServers(addrs []*net.UDPAddr) {
+	var wg sync.WaitGroup
+	for _, srvAddr := range addrs {
+		wg.Add(1)
+		go func(srvAddr *net.UDPAddr) {
+			defer wg.Done()
+			err := p.probeServer(srvAddr, p.config.HealthProbe == "")
+			if p.stopping() {
+				return
+			}
+			key := srvAddr.String()
+			p.hmutex.Lock()
+			_, wasDown := p.unhealthy[key]
+			if err != nil {
+				p.unhealthy[key] = struct{}{}
+			} else {
+				delete(p.unhealthy, key)
+			}
+			p.hmutex.Unlock()
+			switch {
+			case err != nil && !wasDown:
+				p.Vlogs(LevelInfo, "server unhealthy", Fields{Server: key},
+					"Server %s failed its health probe, removed from the pool: %s\n", key, err.Error())
+			case err == nil && wasDown:
+				p.Vlogs(LevelInfo, "server healthy", Fields{Server: key},
+					"Server %s passed its health probe, back in the pool\n", key)
+			}
+		}(srvAddr)
+	}
+	wg.Wait()
+	// Servers Reload or the resolver dropped during the pass
+	p.pruneUnhealthy(p.current().serverAddrs)
+}
+
+// Forget the health of servers not in addrs, so their entries do not pile
+// up and a server added back later starts out healthy until probed
+func (p *Proxy) pruneUnhealthy(addrs []*net.UDPAddr) {
+	current := make(map[string]bool, len(addrs))
+	for _, srvAddr := range addrs {
+		current[srvAddr.String()] = true
+	}
+	p.hmutex.Lock()
+	defer p.hmutex.Unlock()
+	for key := range p.unhealthy {
+		if !current[key] {
+			delete(p.unhealthy, key)
+		}
+	}
+}
+
+// Send HealthProbe to srvAddr from a fresh socket and wait up to
+// HealthProbeTimeout for a reply. With silentOK, as when there is no probe
+// payload to answer, only a refusal counts as a failure.
+func (p *Proxy) probeServer(srvAddr *net.UDPAddr, silentOK bool) error {
+	c, err := p.dialServer(srvAddr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(p.config.HealthProbeTimeout))
+	if _, err := writeServer(c, srvAddr, []byte(p.config.HealthProbe)); err != nil {
+		return err
+	}
+	buffer := make([]byte, p.config.BufferSize)
+	_, err = c.Read(buffer)
+	if silentOK && isTimeout(err) {
+		return nil
+	}
+	if isTimeout(err) {
+		return errors.New("no reply")
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return errors.New("refused")
+	}
+	return err
+}
+
+// Report whether srvAddr passed its last health probe, or has not been
+// probed yet
+func (p *Proxy) healthyServer(srvAddr *net.UDPAddr) bool {
+	p.hmutex.Lock()
+	defer p.hmutex.Unlock()
+	_, down := p.unhealthy[srvAddr.String()]
+	return !down
+}
+
+// Wait before probing a server that refused RequireUpstream again
+const requireBackoff = 100 * time.Millisecond
+
+// Check that every server can be reached before the proxy starts, trying
+// each until RequireUpstreamWait has passed: over UDP the server must
+// reply to HealthProbe, and with "tcp" accept a connection on its
+// host:port. ctx cancels the wait.
+func (p *Proxy) requireUpstream(ctx context.Context) error {
+	addrs, err := p.resolveServers(p.config.Servers)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(p.config.RequireUpstreamWait)
+	for _, srvAddr := range addrs {
+		for {
+			if p.config.RequireUpstream == "tcp" {
+				err = p.connectServer(ctx, srvAddr)
+			} else {
+				err = p.probeServer(srvAddr, false)
+			}
+			if err == nil || !time.Now().Before(deadline) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(requireBackoff):
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("server %s unreachable after %s: %s",
+				srvAddr.String(), p.config.RequireUpstreamWait, err)
+		}
+		p.Vlogf(LevelInfo, "Server %s is reachable\n", srvAddr.String())
+	}
+	return nil
+}
+
+// Open and close a TCP connection to srvAddr's host:port, giving up after
+// HealthProbeTimeout
+func (p *Proxy) connectServer(ctx context.Context, srvAddr *net.UDPAddr) error {
+	dialer := net.Dialer{Timeout: p.config.HealthProbeTimeout}
+	if p.sourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: p.sourceIP}
+	}
+	c, err := dialer.DialContext(ctx, "tcp", srvAddr.String())
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
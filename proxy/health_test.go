@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+// Health is only remembered for servers still configured
+func TestPruneUnhealthy(t *testing.T) {
+	kept := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	p := &Proxy{unhealthy: map[string]struct{}{
+		kept.String():    {},
+		"127.0.0.1:9001": {},
+	}}
+	p.pruneUnhealthy([]*net.UDPAddr{kept})
+	if p.healthyServer(kept) {
+		t.Errorf("%s forgotten while still configured", kept)
+	}
+	removed := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001}
+	if !p.healthyServer(removed) {
+		t.Errorf("%s still unhealthy after it was removed", removed)
+	}
+	if len(p.unhealthy) != 1 {
+		t.Errorf("%d entries left, want 1", len(p.unhealthy))
+	}
+}
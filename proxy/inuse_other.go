@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Report whether err is a bind failing on an address already in use
+func addrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
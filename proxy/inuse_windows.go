@@ -0,0 +1,14 @@
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// WSAEADDRINUSE, which syscall.EADDRINUSE does not match on Windows
+const wsaeaddrinuse = syscall.Errno(10048)
+
+// Report whether err is a bind failing on an address already in use
+func addrInUse(err error) bool {
+	return errors.Is(err, wsaeaddrinuse)
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Go routine which sends KeepalivePayload to the server of every connection
+// whose client has sent nothing for interval, so NAT and firewall state on
+// the way to the server does not time out while the client is quiet. A
+// server that answers keepalives has its replies relayed to the client.
+func (p *Proxy) runKeepalive(interval time.Duration) {
+	defer p.relays.Done()
+	tick := interval / 2
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	payload := []byte(p.config.KeepalivePayload)
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Collected first so no shard stays locked while writing
+		now := time.Now().UnixNano()
+		var quiet []*Connection
+		p.clientDict.each(func(_ *dictShard, _ string, conn *Connection) {
+			if now-atomic.LoadInt64(&conn.lastC2S) >= int64(interval) {
+				quiet = append(quiet, conn)
+			}
+		})
+		for _, conn := range quiet {
+			err := p.writeToServer(conn, payload)
+			if err == errConnectionClosed {
+				continue
+			}
+			fields := conn.fields()
+			if p.checkreportFields(LevelError, fields, err) {
+				continue
+			}
+			atomic.StoreInt64(&conn.lastC2S, now)
+			p.Vlogs(LevelTrace, "sent keepalive", fields, "Sent keepalive to server %s for client %s\n",
+				conn.server().String(), fields.Client)
+		}
+	}
+}
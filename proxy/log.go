@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Verbosity levels. A line is logged when its level is at most the
+// configured verbosity.
+const (
+	LevelQuiet   = 0 // Nothing
+	LevelError   = 1 // Errors and warnings
+	LevelInfo    = 2 // Startup and connection lifecycle
+	LevelDebug   = 3 // Every relayed datagram
+	LevelVerbose = 4 // Dropped and refused datagrams
+	LevelTrace   = 5 // Client dictionary lookups and hex dumps
+	LevelAll     = 6 // Everything
+)
+
+// Names accepted by ParseLevel
+var levelNames = map[string]int{
+	"quiet":   LevelQuiet,
+	"error":   LevelError,
+	"info":    LevelInfo,
+	"debug":   LevelDebug,
+	"verbose": LevelVerbose,
+	"trace":   LevelTrace,
+	"all":     LevelAll,
+}
+
+// Areas of the proxy whose verbosity can be set apart from the rest
+const (
+	areaDefault = iota // Everything outside the areas below
+	areaProxy          // Datagrams from clients, as read by runProxy
+	areaConn           // Datagrams from servers, as read by runConnection
+	areaErrors         // Errors reported through checkreport
+	areaCount
+)
+
+// Names accepted for the areas in Config.AreaVerbosity and ParseVerbosity
+var areaNames = map[string]int{
+	"proxy":  areaProxy,
+	"conn":   areaConn,
+	"errors": areaErrors,
+}
+
+// Parse a verbosity given as a number or as a level name such as "debug"
+func ParseLevel(s string) (int, error) {
+	if level, ok := levelNames[strings.ToLower(s)]; ok {
+		return level, nil
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("verbosity %q is not a number or one of quiet, error, info, debug, verbose, trace, all", s)
+	}
+	if level < LevelQuiet || level > LevelAll {
+		return 0, fmt.Errorf("verbosity %d out of range %d-%d", level, LevelQuiet, LevelAll)
+	}
+	return level, nil
+}
+
+// Parse a comma-separated verbosity spec such as "2,proxy=5,errors=1". A
+// plain level sets the verbosity of everything without its own; level is
+// returned unchanged if there is none. Each area=level item sets the
+// verbosity of one area.
+func ParseVerbosity(spec string, level int) (int, map[string]int, error) {
+	var areas map[string]int
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		name, value := "", item
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			name, value = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+		l, err := ParseLevel(value)
+		if err != nil {
+			return 0, nil, err
+		}
+		if name == "" {
+			level = l
+			continue
+		}
+		if _, found := areaNames[name]; !found {
+			return 0, nil, fmt.Errorf("verbosity area %q is not one of proxy, conn, errors", name)
+		}
+		if areas == nil {
+			areas = make(map[string]int)
+		}
+		areas[name] = l
+	}
+	return level, areas, nil
+}
+
+// Destination for proxy log output. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Logger that also wants the verbosity level of each line, such as a
+// system logger that files errors apart from information. Used in place of
+// Printf when the configured Logger implements it.
+type LevelLogger interface {
+	Logger
+	Logf(level int, format string, v ...interface{})
+}
+
+// Structured fields attached to a log line. Empty fields are omitted.
+type Fields struct {
+	Conn   uint64 // ID of the connection the line is about, 0 if none
+	Client string // Client address
+	Server string // Server address
+	Local  string // Local address the server is reached from
+	Bytes  int    // Datagram size
+
+	// Totals and timings of a connection being torn down, nil otherwise
+	Session *Stats
+
+	area int // Area whose verbosity applies, not logged
+}
+
+// Layout of the first and last datagram timestamps in log lines
+const seenFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// A connection's totals and timings as written in JSON format
+type sessionRecord struct {
+	Duration   float64 `json:"duration_seconds"`
+	C2SBytes   uint64  `json:"c2s_bytes"`
+	C2SPackets uint64  `json:"c2s_packets"`
+	C2SFirst   string  `json:"c2s_first,omitempty"`
+	C2SLast    string  `json:"c2s_last,omitempty"`
+	S2CBytes   uint64  `json:"s2c_bytes"`
+	S2CPackets uint64  `json:"s2c_packets"`
+	S2CFirst   string  `json:"s2c_first,omitempty"`
+	S2CLast    string  `json:"s2c_last,omitempty"`
+}
+
+func newSessionRecord(st *Stats) *sessionRecord {
+	if st == nil {
+		return nil
+	}
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(seenFormat)
+	}
+	return &sessionRecord{
+		Duration:   st.Duration.Seconds(),
+		C2SBytes:   st.C2SBytes,
+		C2SPackets: st.C2SPackets,
+		C2SFirst:   format(st.C2SFirst),
+		C2SLast:    format(st.C2SLast),
+		S2CBytes:   st.S2CBytes,
+		S2CPackets: st.S2CPackets,
+		S2CFirst:   format(st.S2CFirst),
+		S2CLast:    format(st.S2CLast),
+	}
+}
+
+// A log line as written in JSON format
+type logRecord struct {
+	Time   string `json:"time"`
+	Level  int    `json:"level"`
+	Msg    string `json:"msg"`
+	Conn   uint64 `json:"conn,omitempty"`
+	Client string `json:"client,omitempty"`
+	Server string `json:"server,omitempty"`
+	Local  string `json:"local,omitempty"`
+	Bytes  int    `json:"bytes,omitempty"`
+
+	Session *sessionRecord `json:"session,omitempty"`
+}
+
+// Whether a line at level in area would be logged
+func (p *Proxy) logs(level, area int) bool {
+	return int32(level) <= atomic.LoadInt32(&p.verbosity[area])
+}
+
+// Log result if verbosity level high enough
+func (p *Proxy) Vlogf(level int, format string, v ...interface{}) {
+	p.Vlogs(level, "", Fields{}, format, v...)
+}
+
+// Log a line carrying structured fields if verbosity level high enough.
+// Text output is format applied to v, exactly as Vlogf, after the
+// connection ID if there is one. JSON output uses msg as the message, or
+// the formatted text when msg is empty, and carries the fields as separate
+// keys.
+func (p *Proxy) Vlogs(level int, msg string, f Fields, format string, v ...interface{}) {
+	if !p.logs(level, f.area) {
+		return
+	}
+	if p.config.LogFormat != "json" {
+		if f.Conn != 0 {
+			format = "conn %d: " + format
+			v = append([]interface{}{f.Conn}, v...)
+		}
+		p.printf(level, format, v...)
+		return
+	}
+	if msg == "" {
+		msg = strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+	}
+	line, err := json.Marshal(logRecord{
+		Time:   time.Now().Format(time.RFC3339Nano),
+		Level:  level,
+		Msg:    msg,
+		Conn:   f.Conn,
+		Client: f.Client,
+		Server: f.Server,
+		Local:  f.Local,
+		Bytes:  f.Bytes,
+
+		Session: newSessionRecord(f.Session),
+	})
+	if err != nil {
+		return
+	}
+	p.printf(level, "%s", line)
+}
+
+// Write one line to the logger, with its level if it takes one
+func (p *Proxy) printf(level int, format string, v ...interface{}) {
+	if ll, ok := p.logger.(LevelLogger); ok {
+		ll.Logf(level, format, v...)
+		return
+	}
+	p.logger.Printf(format, v...)
+}
+
+// Payload as shown in relay log lines: quoted raw bytes, or with HexDump
+// set just the size, the bytes being dumped by dumpPayload instead
+func (p *Proxy) payload(data []byte) string {
+	if p.config.HexDump {
+		return fmt.Sprintf("%d bytes", len(data))
+	}
+	return "'" + string(data) + "'"
+}
+
+// Log a hex dump of the first HexDumpBytes of data at LevelTrace when
+// HexDump is set
+func (p *Proxy) dumpPayload(f Fields, data []byte) {
+	if !p.config.HexDump || !p.logs(LevelTrace, f.area) {
+		return
+	}
+	if len(data) > p.config.HexDumpBytes {
+		data = data[:p.config.HexDumpBytes]
+	}
+	p.Vlogs(LevelTrace, "payload", f, "%s", hex.Dump(data))
+}
+
+// Log the CRC32 of data at LevelTrace when Checksum is set. stage says
+// where in the relay data was hashed, so hashes taken before and after the
+// transformer can be told apart.
+func (p *Proxy) logChecksum(f Fields, stage string, data []byte) {
+	if !p.config.Checksum || !p.logs(LevelTrace, f.area) {
+		return
+	}
+	p.Vlogs(LevelTrace, "checksum", f, "CRC32 %08x of %d bytes for client %s %s\n",
+		crc32.ChecksumIEEE(data), len(data), f.Client, stage)
+}
+
+// Handle errors
+func (p *Proxy) checkreport(level int, err error) bool {
+	return p.checkreportFields(level, Fields{}, err)
+}
+
+// Handle errors, logging them with fields such as the connection ID
+func (p *Proxy) checkreportFields(level int, f Fields, err error) bool {
+	if err == nil {
+		return false
+	}
+	errorsReported.Inc()
+	atomic.AddUint64(&p.errorCount, 1)
+	f.area = areaErrors
+	p.Vlogs(level, "", f, "Error: %s", err.Error())
+	return true
+}
+
+// Logger used when Config.Logger is nil. JSON lines carry their own time,
+// so they are written without the log package prefix.
+func defaultLogger(format string) Logger {
+	if format == "json" {
+		return log.New(os.Stderr, "", 0)
+	}
+	return log.Default()
+}
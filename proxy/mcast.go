@@ -0,0 +1,89 @@
+package proxy
+
+// A server address may be a multicast group, for fanning client datagrams
+// out to every member. Each connection then has an unconnected socket of
+// its own, joined to the group on McastIface, and relays whatever arrives
+// on it back to its client: unicast answers from any member, and datagrams
+// sent to the group at that socket's port. Replies are told apart only by
+// the port they are sent to, so the client hears one answer per member,
+// and a member answering to the group's own port rather than the sender's
+// reaches no client at all.
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Look up McastIface, leaving the system default interface if it is empty
+func (p *Proxy) setupMulticast() error {
+	if p.config.McastIface == "" {
+		return nil
+	}
+	ifi, err := net.InterfaceByName(p.config.McastIface)
+	if err != nil {
+		return fmt.Errorf("multicast interface %s: %v", p.config.McastIface, err)
+	}
+	p.mcastIface = ifi
+	return nil
+}
+
+// Open an unconnected socket sending to the multicast group with McastTTL
+// from McastIface, and joined to the group there
+func (p *Proxy) listenMulticast(group *net.UDPAddr) (*net.UDPConn, error) {
+	srvudp, err := p.bindLocalPort(func(port int) (*net.UDPConn, error) {
+		return net.ListenUDP(p.dialNetwork(group), &net.UDPAddr{IP: p.sourceIP, Port: port})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if group.IP.To4() != nil {
+		err = joinGroup4(ipv4.NewPacketConn(srvudp), p.mcastIface, group, p.config.McastTTL)
+	} else {
+		err = joinGroup6(ipv6.NewPacketConn(srvudp), p.mcastIface, group, p.config.McastTTL)
+	}
+	if err != nil {
+		srvudp.Close()
+		return nil, err
+	}
+	return srvudp, nil
+}
+
+func joinGroup4(c *ipv4.PacketConn, ifi *net.Interface, group *net.UDPAddr, ttl int) error {
+	if ifi != nil {
+		if err := c.SetMulticastInterface(ifi); err != nil {
+			return err
+		}
+	}
+	if ttl != 0 {
+		if err := c.SetMulticastTTL(ttl); err != nil {
+			return err
+		}
+	}
+	return c.JoinGroup(ifi, group)
+}
+
+func joinGroup6(c *ipv6.PacketConn, ifi *net.Interface, group *net.UDPAddr, hops int) error {
+	if ifi != nil {
+		if err := c.SetMulticastInterface(ifi); err != nil {
+			return err
+		}
+	}
+	if hops != 0 {
+		if err := c.SetMulticastHopLimit(hops); err != nil {
+			return err
+		}
+	}
+	return c.JoinGroup(ifi, group)
+}
+
+// Write data on c, a socket from dialServer to srvAddr. Only a socket to a
+// multicast group is left unconnected and needs the address.
+func writeServer(c *net.UDPConn, srvAddr *net.UDPAddr, data []byte) (int, error) {
+	if srvAddr.IP.IsMulticast() {
+		return c.WriteToUDP(data, srvAddr)
+	}
+	return c.Write(data)
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus collectors, shared by every Proxy in the process
+var (
+	packetsRelayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "udpproxy_packets_relayed_total",
+		Help: "Datagrams relayed, by direction and server.",
+	}, []string{"direction", "server"})
+	bytesRelayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "udpproxy_bytes_relayed_total",
+		Help: "Payload bytes relayed, by direction and server.",
+	}, []string{"direction", "server"})
+	errorsReported = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "udpproxy_errors_total",
+		Help: "Errors reported by the proxy.",
+	})
+	packetsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "udpproxy_packets_dropped_total",
+		Help: "Datagrams dropped instead of relayed, by reason: ratelimit for the per-client rate, policy for admission checks, DropRate and the transformer, oversize for datagrams over MaxPacket or the buffer, denylist for clients the allow and deny lists refuse, msgsize for writes failing with EMSGSIZE.",
+	}, []string{"reason"})
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "udpproxy_connections",
+		Help: "Client connections currently in the dictionary, by server.",
+	}, []string{"server"})
+	roundTrip = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "udpproxy_rtt_seconds",
+		Help:    "Coarse round trip estimates with RTT probing, from a datagram written to a server to the next one read back, by server.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"server"})
+)
+
+// Counters resolved once so the relay loops avoid a label lookup per packet
+var dropped [dropReasons]prometheus.Counter
+
+// Collectors of one server, resolved once per server for the same reason
+type serverMetrics struct {
+	server               string // Label they carry
+	c2sPackets, c2sBytes prometheus.Counter
+	s2cPackets, s2cBytes prometheus.Counter
+	connections          prometheus.Gauge
+	rtt                  prometheus.Observer
+
+	// Connections counted against them, and whether Reload removed their
+	// server, guarded by the smmutex of the Proxy holding them
+	conns   int
+	removed bool
+}
+
+// Proxies holding collectors of each server label, so a series that
+// several proxies of one process share is only deleted once none of them
+// uses it. Guarded by lumutex.
+var (
+	labelUsers = make(map[string]int)
+	lumutex    sync.Mutex
+)
+
+// Collectors labelled with server, as serverLabel names it
+func newServerMetrics(server string) *serverMetrics {
+	lumutex.Lock()
+	labelUsers[server]++
+	lumutex.Unlock()
+	return &serverMetrics{
+		server:      server,
+		c2sPackets:  packetsRelayed.WithLabelValues("client_to_server", server),
+		c2sBytes:    bytesRelayed.WithLabelValues("client_to_server", server),
+		s2cPackets:  packetsRelayed.WithLabelValues("server_to_client", server),
+		s2cBytes:    bytesRelayed.WithLabelValues("server_to_client", server),
+		connections: activeConnections.WithLabelValues(server),
+		rtt:         roundTrip.WithLabelValues(server),
+	}
+}
+
+// Count a connection against the collectors labelled server, making them
+// the first time the server is used
+func (p *Proxy) attachMetrics(server string) *serverMetrics {
+	p.smmutex.Lock()
+	m := p.srvMetrics[server]
+	if m == nil {
+		m = newServerMetrics(server)
+		p.srvMetrics[server] = m
+	}
+	m.conns++
+	p.smmutex.Unlock()
+	m.connections.Inc()
+	return m
+}
+
+// Stop counting a connection against m, forgetting m once the last
+// connection of a server Reload removed has closed
+func (p *Proxy) detachMetrics(m *serverMetrics) {
+	m.connections.Dec()
+	p.smmutex.Lock()
+	defer p.smmutex.Unlock()
+	m.conns--
+	if m.removed && m.conns == 0 {
+		p.forgetMetrics(m)
+	}
+}
+
+// Mark the collectors of server entries in old that are not in current as
+// removed, forgetting those with no connections left. Those of entries in
+// current are kept, even if an earlier reload removed them.
+func (p *Proxy) removeServerMetrics(old, current []string) {
+	kept := make(map[string]bool)
+	for _, entry := range current {
+		hostport, _, _ := parseServer(entry)
+		kept[hostport] = true
+	}
+	p.smmutex.Lock()
+	defer p.smmutex.Unlock()
+	for hostport := range kept {
+		if m := p.srvMetrics[hostport]; m != nil {
+			m.removed = false
+		}
+	}
+	for _, entry := range old {
+		hostport, _, _ := parseServer(entry)
+		m := p.srvMetrics[hostport]
+		if m == nil || kept[hostport] {
+			continue
+		}
+		m.removed = true
+		if m.conns == 0 {
+			p.forgetMetrics(m)
+		}
+	}
+}
+
+// Drop m and, unless another proxy still uses its label, stop exporting
+// its series. Caller must hold smmutex.
+func (p *Proxy) forgetMetrics(m *serverMetrics) {
+	if p.srvMetrics[m.server] != m {
+		return
+	}
+	delete(p.srvMetrics, m.server)
+	lumutex.Lock()
+	defer lumutex.Unlock()
+	if labelUsers[m.server]--; labelUsers[m.server] > 0 {
+		return
+	}
+	delete(labelUsers, m.server)
+	for _, direction := range []string{"client_to_server", "server_to_client"} {
+		packetsRelayed.DeleteLabelValues(direction, m.server)
+		bytesRelayed.DeleteLabelValues(direction, m.server)
+	}
+	activeConnections.DeleteLabelValues(m.server)
+	roundTrip.DeleteLabelValues(m.server)
+}
+
+// Server label of metrics for a connection pinned to srvAddr, one of the
+// addresses in s: the host:port of its server entry as configured, not
+// what that resolved to. ServerUnix for a unix server, empty in echo mode.
+func (p *Proxy) serverLabel(s *settings, srvAddr *net.UDPAddr) string {
+	if srvAddr == nil {
+		return p.config.ServerUnix
+	}
+	for i, addr := range s.serverAddrs {
+		if addr == srvAddr || addr.String() == srvAddr.String() {
+			hostport, _, _ := parseServer(s.servers[i])
+			return hostport
+		}
+	}
+	return srvAddr.String()
+}
+
+func init() {
+	for reason, name := range dropNames {
+		dropped[reason] = packetsDropped.WithLabelValues(name)
+	}
+	prometheus.MustRegister(packetsRelayed, bytesRelayed, packetsDropped,
+		errorsReported, activeConnections, roundTrip)
+}
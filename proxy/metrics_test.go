@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Server metrics carry the server entry as configured, weight aside,
+// whatever address it resolved to
+func TestServerLabel(t *testing.T) {
+	p := &Proxy{}
+	resolved := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 9001}
+	s := newSettings(Config{Servers: []string{"localhost:9000=3", "127.0.0.2:9001"}},
+		[]*net.UDPAddr{resolved, other})
+
+	again := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	if got := p.serverLabel(s, again); got != "localhost:9000" {
+		t.Errorf("label %q, want %q", got, "localhost:9000")
+	}
+	if got := p.serverLabel(s, other); got != "127.0.0.2:9001" {
+		t.Errorf("label %q, want %q", got, "127.0.0.2:9001")
+	}
+}
+
+// Report whether the connections gauge of server is exported
+func exported(t *testing.T, server string) bool {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "udpproxy_connections" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "server" && label.GetValue() == server {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// A server a reload removes keeps its series while connections to it are
+// open, and while another proxy still relays to it
+func TestRemovedServerMetrics(t *testing.T) {
+	const server = "removed.test:9000"
+	p := &Proxy{srvMetrics: make(map[string]*serverMetrics)}
+	other := &Proxy{srvMetrics: make(map[string]*serverMetrics)}
+
+	m := p.attachMetrics(server)
+	p.removeServerMetrics([]string{server + "=2"}, nil)
+	if !exported(t, server) {
+		t.Fatal("series deleted while a connection is open")
+	}
+	other.detachMetrics(other.attachMetrics(server))
+	p.detachMetrics(m)
+	if !exported(t, server) {
+		t.Fatal("series deleted while another proxy uses the server")
+	}
+	if _, ok := p.srvMetrics[server]; ok {
+		t.Error("collectors of a removed server kept after its last connection")
+	}
+
+	other.removeServerMetrics([]string{server}, []string{"kept.test:9000"})
+	if exported(t, server) {
+		t.Fatal("series still exported once no proxy uses the server")
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// Open the socket every client datagram is copied to when Mirror is set
+func (p *Proxy) dialMirror() error {
+	maddr, err := net.ResolveUDPAddr(p.config.Network, p.config.Mirror)
+	if err != nil {
+		return err
+	}
+	mudp, err := p.dialServer(maddr)
+	if err != nil {
+		return err
+	}
+	p.mirrorConn, p.mirrorAddr = mudp, maddr
+	return nil
+}
+
+// Copy data to the mirror, if any. Failures are only logged, at
+// LevelVerbose, so the mirror cannot disturb the primary path.
+func (p *Proxy) mirror(data []byte, fields Fields) {
+	if p.mirrorConn == nil {
+		return
+	}
+	p.armWrite(p.mirrorConn)
+	if _, err := writeServer(p.mirrorConn, p.mirrorAddr, data); err != nil {
+		p.Vlogs(LevelVerbose, "mirror write failed", fields,
+			"Failed to mirror packet from client %s: %s\n", fields.Client, err.Error())
+	}
+}
+
+// Go routine which reads and discards the mirror's replies, so they do not
+// sit in the socket buffer
+func (p *Proxy) runMirrorDrain() {
+	defer p.relays.Done()
+	buffer := make([]byte, p.config.BufferSize)
+	for {
+		_, err := p.mirrorConn.Read(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil && !p.readBackoff() {
+			return
+		}
+	}
+}
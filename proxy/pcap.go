@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Relayed datagrams written to a pcap file when Pcap is set. Each is
+// framed in synthesized IP and UDP headers carrying the client and server
+// addresses, so a capture reads as if taken between the two. Datagrams of
+// unix clients, and of echo mode, which has no server, are not captured.
+type capture struct {
+	file   *os.File
+	buf    *bufio.Writer
+	writer *pcapgo.Writer
+
+	// Guards the writers, and closed, which is set once the file is closed
+	mutex  sync.Mutex
+	closed bool
+}
+
+// Create the capture file and write its header
+func openCapture(path string) (*capture, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &capture{file: file, buf: bufio.NewWriter(file)}
+	c.writer = pcapgo.NewWriter(c.buf)
+	if err := c.writer.WriteFileHeader(maxFrame, layers.LinkTypeRaw); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Flush and close the capture file. Datagrams relayed afterwards are not
+// captured.
+func (c *capture) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	err := c.buf.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Write data to the capture, if any, as a datagram sent from src to dst
+func (p *Proxy) capture(src, dst net.Addr, data []byte) {
+	if p.pcap == nil {
+		return
+	}
+	srcudp, _ := src.(*net.UDPAddr)
+	dstudp, _ := dst.(*net.UDPAddr)
+	if srcudp == nil || dstudp == nil {
+		return
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcudp.Port), DstPort: layers.UDPPort(dstudp.Port)}
+	var ip gopacket.NetworkLayer
+	if src4, dst4 := srcudp.IP.To4(), dstudp.IP.To4(); src4 != nil && dst4 != nil {
+		ip = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src4, DstIP: dst4}
+	} else {
+		// A mixed pair is written with the IPv4 address mapped into IPv6
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP,
+			SrcIP: srcudp.IP.To16(), DstIP: dstudp.IP.To16()}
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, ip.(gopacket.SerializableLayer), udp, gopacket.Payload(data))
+	if p.checkreport(LevelError, err) {
+		return
+	}
+	packet := buf.Bytes()
+	info := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(packet), Length: len(packet)}
+
+	c := p.pcap
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	p.checkreport(LevelError, c.writer.WritePacket(info, packet))
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Ask the kernel to report the destination address of each datagram read
+// from c. A dual-stack socket gets both families' control messages, as v4
+// clients on it are reported through IP_PKTINFO.
+func enablePacketInfo(c *net.UDPConn) error {
+	laddr := c.LocalAddr().(*net.UDPAddr)
+	if laddr.IP.To4() != nil {
+		return ipv4.NewPacketConn(c).SetControlMessage(ipv4.FlagDst, true)
+	}
+	if err := ipv6.NewPacketConn(c).SetControlMessage(ipv6.FlagDst, true); err != nil {
+		return err
+	}
+	if laddr.IP.IsUnspecified() {
+		ipv4.NewPacketConn(c).SetControlMessage(ipv4.FlagDst, true)
+	}
+	return nil
+}
+
+// Buffer large enough for the control messages enablePacketInfo asks for
+func newPacketInfoBuffer() []byte {
+	n4 := len(ipv4.NewControlMessage(ipv4.FlagDst))
+	n6 := len(ipv6.NewControlMessage(ipv6.FlagDst))
+	if n4 > n6 {
+		return make([]byte, n4+n6)
+	}
+	return make([]byte, 2*n6)
+}
+
+// Destination IP of a datagram from the control messages read with it,
+// nil if there was none
+func packetDst(oob []byte) net.IP {
+	var cm4 ipv4.ControlMessage
+	if cm4.Parse(oob) == nil && cm4.Dst != nil {
+		return cm4.Dst
+	}
+	var cm6 ipv6.ControlMessage
+	if cm6.Parse(oob) == nil && cm6.Dst != nil {
+		return cm6.Dst
+	}
+	return nil
+}
+
+// Control message making a reply to cliaddr leave from src, the address
+// the client sent to
+func replyPacketInfo(cliaddr *net.UDPAddr, src net.IP) []byte {
+	if cliaddr.IP.To4() != nil {
+		return (&ipv4.ControlMessage{Src: src.To4()}).Marshal()
+	}
+	return (&ipv6.ControlMessage{Src: src}).Marshal()
+}
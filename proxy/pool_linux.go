@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+// With ConnModel "pool", replies from servers are read by a fixed set of
+// ConnWorkers routines instead of one runConnection routine per
+// connection. Every server socket is registered one-shot with a single
+// epoll instance; the worker woken for a socket reads what is queued on it
+// without blocking, relays it and re-arms the socket.
+//
+// A parked runConnection routine costs little more than its stack, so the
+// default model is the better one for up to many thousands of clients.
+// The pool bounds routines, stacks and scheduler work at any number of
+// connections, but a worker busy with one connection holds up every socket
+// it would otherwise serve: a bandwidth limit or a slow client delays the
+// replies of other clients too. It suits very many mostly idle clients.
+// Read errors, whose handling may sleep while redialing, get a routine of
+// their own, and TCP bridged clients still have one each for their stream.
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// The pool needs epoll, which is Linux only
+const havePool = true
+
+// Datagrams a worker reads from one socket before others get a turn
+const poolQuota = 64
+
+// Milliseconds a worker waits for a ready socket before checking whether
+// the proxy is closing
+const poolWait = 100
+
+// Epoll instance watching the server sockets of every connection
+type connPool struct {
+	epfd int
+
+	// Connections whose socket is registered, by ID, guarded by mutex. The
+	// ID rather than the descriptor goes in each event, so an event for a
+	// closed socket whose descriptor has been reused is recognised as stale.
+	conns  map[uint64]*Connection
+	closed bool
+	mutex  sync.Mutex
+}
+
+func newConnPool() (*connPool, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	return &connPool{epfd: epfd, conns: make(map[uint64]*Connection)}, nil
+}
+
+// Number of pool workers for ConnWorkers
+func poolWorkers(n int) int {
+	if n == 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return n
+}
+
+// Socket replies from conn's server are read from
+func serverSocket(conn *Connection) syscall.Conn {
+	if conn.ServerUnix != nil {
+		return conn.ServerUnix
+	}
+	return conn.serverConn()
+}
+
+// Arm conn's current server socket to wake one worker when a datagram is
+// queued on it, registering the socket first if need be
+func (cp *connPool) arm(conn *Connection) error {
+	rc, err := serverSocket(conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	// Registered before the socket is armed, and dropped again if that
+	// fails, so it cannot outlive a removeConnection racing with this
+	cp.mutex.Lock()
+	cp.conns[conn.ID] = conn
+	cp.mutex.Unlock()
+	ev := syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLONESHOT,
+		Fd:     int32(conn.ID),
+		Pad:    int32(conn.ID >> 32),
+	}
+	var cerr error
+	err = rc.Control(func(fd uintptr) {
+		cerr = syscall.EpollCtl(cp.epfd, syscall.EPOLL_CTL_MOD, int(fd), &ev)
+		if cerr == syscall.ENOENT {
+			cerr = syscall.EpollCtl(cp.epfd, syscall.EPOLL_CTL_ADD, int(fd), &ev)
+		}
+	})
+	if err == nil {
+		err = os.NewSyscallError("epoll_ctl", cerr)
+	}
+	if err != nil {
+		cp.forget(conn)
+	}
+	return err
+}
+
+// Stop waking workers for conn. Closing its socket has already taken it
+// out of the epoll set.
+func (cp *connPool) forget(conn *Connection) {
+	cp.mutex.Lock()
+	delete(cp.conns, conn.ID)
+	cp.mutex.Unlock()
+}
+
+// Connection an event is for, nil if it has been forgotten
+func (cp *connPool) lookup(ev syscall.EpollEvent) *Connection {
+	id := uint64(uint32(ev.Fd)) | uint64(uint32(ev.Pad))<<32
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	return cp.conns[id]
+}
+
+// Close the epoll instance once the workers have returned
+func (cp *connPool) close() {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if !cp.closed {
+		cp.closed = true
+		syscall.Close(cp.epfd)
+	}
+}
+
+// Worker routine which relays replies from whichever server sockets are ready
+func (p *Proxy) runPoolWorker() {
+	defer p.relays.Done()
+	events := make([]syscall.EpollEvent, 8)
+	for !p.stopping() {
+		n, err := syscall.EpollWait(p.pool.epfd, events, poolWait)
+		if err == syscall.EINTR {
+			continue
+		}
+		if p.checkreport(LevelError, os.NewSyscallError("epoll_wait", err)) {
+			if !p.readBackoff() {
+				return
+			}
+			continue
+		}
+		for _, ev := range events[:n] {
+			if conn := p.pool.lookup(ev); conn != nil {
+				p.poolRelay(conn)
+			}
+		}
+	}
+}
+
+// Relay up to poolQuota datagrams queued on conn's server socket, then
+// arm it again. Read errors are handled as by runConnection.
+func (p *Proxy) poolRelay(conn *Connection) {
+	bufp := p.bufPool.Get().(*[]byte)
+	defer p.bufPool.Put(bufp)
+	sock := serverSocket(conn)
+	for i := 0; i < poolQuota; i++ {
+		n, flags, err := readNow(sock, *bufp)
+		if err == syscall.EAGAIN {
+			break
+		}
+		if errors.Is(err, net.ErrClosed) {
+			// Torn down, or failed over to a socket armed by failover
+			return
+		}
+		if err != nil {
+			p.relays.Add(1)
+			go func() {
+				defer p.relays.Done()
+				// A redial arms the new socket itself
+				if p.serverReadError(conn, os.NewSyscallError("recvmsg", err)) && serverSocket(conn) == sock {
+					p.rearm(conn)
+				}
+			}()
+			return
+		}
+		conn.readErrors = 0
+		atomic.StoreUint32(&conn.refusals, 0)
+		p.relayToClient(conn, *bufp, n, flags)
+	}
+	if serverSocket(conn) == sock {
+		p.rearm(conn)
+	}
+}
+
+// Read one datagram from sock into buffer without waiting; EAGAIN if none
+// is queued
+func readNow(sock syscall.Conn, buffer []byte) (n, flags int, err error) {
+	rc, err := sock.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	cerr := rc.Read(func(fd uintptr) bool {
+		n, _, flags, _, err = syscall.Recvmsg(int(fd), buffer, nil, syscall.MSG_DONTWAIT)
+		return true
+	})
+	if cerr != nil {
+		return 0, 0, cerr
+	}
+	return n, flags, err
+}
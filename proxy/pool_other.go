@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+// The pool needs epoll, which is Linux only, so every connection has its
+// own runConnection routine elsewhere
+const havePool = false
+
+type connPool struct{}
+
+func newConnPool() (*connPool, error) { return nil, nil }
+
+func poolWorkers(n int) int { return 0 }
+
+func (cp *connPool) arm(conn *Connection) error { return nil }
+
+func (cp *connPool) forget(conn *Connection) {}
+
+func (cp *connPool) close() {}
+
+func (p *Proxy) runPoolWorker() {}
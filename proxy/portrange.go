@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Returned, wrapped, when every port of LocalPortRange is in use
+var errNoLocalPort = errors.New("no free local port")
+
+// Parse a LocalPortRange of the form lo-hi
+func parsePortRange(s string) (lo, hi int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%q is not lo-hi", s)
+	}
+	if lo, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("%q is not lo-hi", s)
+	}
+	if hi, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, fmt.Errorf("%q is not lo-hi", s)
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("%d-%d is not a range within 1-65535", lo, hi)
+	}
+	return lo, hi, nil
+}
+
+// Open a server socket with bind, given the local port to use: with
+// LocalPortRange, each port of the range in turn, starting after the one
+// last handed out, until one is not in use; else 0 for the system to pick.
+func (p *Proxy) bindLocalPort(bind func(port int) (*net.UDPConn, error)) (*net.UDPConn, error) {
+	if p.portHi == 0 {
+		return bind(0)
+	}
+	n := uint32(p.portHi - p.portLo + 1)
+	for i := uint32(0); i < n; i++ {
+		port := p.portLo + int((atomic.AddUint32(&p.nextPort, 1)-1)%n)
+		c, err := bind(port)
+		if err == nil || !addrInUse(err) {
+			return c, err
+		}
+	}
+	return nil, fmt.Errorf("%w in range %d-%d", errNoLocalPort, p.portLo, p.portHi)
+}
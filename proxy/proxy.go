@@ -0,0 +1,1017 @@
+// Package proxy implements a UDP proxy that relays datagrams between
+// clients and one or more servers.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A UDP proxy. Each instance has its own sockets and client dictionary.
+type Proxy struct {
+	// Totals across all connections since Start, updated atomically and
+	// kept first for 64-bit alignment. The Duration of totals is unused.
+	totals     Stats
+	errorCount uint64
+	drops      [dropReasons]uint64 // By reason
+
+	// Latest connection ID handed out, updated atomically
+	lastConnID uint64
+
+	// When warnTruncated last warned in Unix nanoseconds, updated atomically
+	truncWarned int64
+
+	// Connections in the dictionary plus slots reserved for ones being
+	// created, updated atomically
+	connCount int64
+
+	// Configuration given to New. Fields that Reload may change are read
+	// from live instead.
+	config      Config
+	logger      Logger
+	transformer Transformer
+
+	// Sockets used by clients as the proxy server, one per worker, all
+	// bound to the same address
+	proxyConns []*net.UDPConn
+
+	// Settings Reload may replace, guarded by cmutex. Read through current.
+	live   *settings
+	cmutex sync.RWMutex
+
+	// Verbosity of live by area, updated atomically with it so a line at a
+	// disabled level is skipped without taking cmutex
+	verbosity [areaCount]int32
+
+	// Round-robin counter used to pick a server
+	serverIndex uint32
+
+	// Mapping from client addresses (as host:port) to connection
+	clientDict *clientDict
+
+	// Tracks the proxy, connection and reaper routines so Close can wait for them
+	relays sync.WaitGroup
+
+	// Set when the proxy sockets report the destination of each datagram
+	pktinfo bool
+
+	// Unix datagram socket used by clients instead of the proxy sockets,
+	// nil unless ListenUnix is set
+	unixConn *net.UnixConn
+
+	// Socket shared by all connections, nil unless SingleUpstreamSocket or
+	// Collapse is set
+	upstream *upstream
+
+	// Decoded RequirePrefix
+	firstPrefix []byte
+
+	// Parsed SourceIP, nil unless set
+	sourceIP net.IP
+
+	// Parsed LocalPortRange, both 0 unless set, and where the next search
+	// of it starts, updated atomically
+	portLo, portHi int
+	nextPort       uint32
+
+	// Seals the client leg, nil unless PSK is set
+	psk *pskCipher
+
+	// Compress the server and client legs, nil unless Compress and
+	// CompressClient are set
+	serverCodec *codec
+	clientCodec *codec
+
+	// Socket client datagrams are copied to, nil unless Mirror is set
+	mirrorConn *net.UDPConn
+	mirrorAddr *net.UDPAddr
+
+	// Interface multicast servers are reached on, nil for the system default
+	mcastIface *net.Interface
+
+	// Servers clients were pinned to before a restart, by client key, read
+	// from StateFile and guarded by rsmutex
+	restored map[string]string
+	rsmutex  sync.Mutex
+
+	// Capture file relayed datagrams are written to, nil unless Pcap is set
+	pcap *capture
+
+	// Reads the server sockets, nil unless ConnModel is "pool"
+	pool *connPool
+
+	// Listener for TCP bridged clients, nil unless ListenTCP is set
+	tcpListener net.Listener
+
+	// Set once the proxy socket is bound
+	bound uint32
+
+	// Set while refusing new clients, see SetDraining
+	draining uint32
+
+	// Cancelled by Close. Every routine of the proxy returns once it is
+	// done; those blocked reading a socket are woken by Close closing it.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	// Random source for drop decisions, guarded by drmutex
+	dropRand *rand.Rand
+	drmutex  sync.Mutex
+
+	// Servers whose dial failed, mapped to the end of their cooldown.
+	// Guarded by dfmutex.
+	dialFailed map[string]time.Time
+	dfmutex    sync.Mutex
+
+	// Connections open per client subnet under MaxPerSubnet, guarded by
+	// snmutex
+	subnets map[string]int
+	snmutex sync.Mutex
+
+	// Servers that failed their last health probe, guarded by hmutex
+	unhealthy map[string]struct{}
+	hmutex    sync.Mutex
+
+	// Collectors of the servers connections are pinned to, by label,
+	// guarded by smmutex. Labels are server entries as configured, so there
+	// is one per server whatever its name resolves to.
+	srvMetrics map[string]*serverMetrics
+	smmutex    sync.Mutex
+
+	// Set once a clamped socket buffer has been warned about
+	clampWarned uint32
+
+	// Pool of datagram buffers, each BufferSize bytes long
+	bufPool sync.Pool
+}
+
+// Create a proxy from config. Nothing is bound until Start.
+func New(config Config) *Proxy {
+	config.setDefaults()
+	p := &Proxy{
+		config:      config,
+		logger:      config.Logger,
+		transformer: config.Transformer,
+		serverCodec: newCodec(config.Compress),
+		clientCodec: newCodec(config.CompressClient),
+		dialFailed:  make(map[string]time.Time),
+		unhealthy:   make(map[string]struct{}),
+		srvMetrics:  make(map[string]*serverMetrics),
+		subnets:     make(map[string]int),
+	}
+	if p.logger == nil {
+		p.logger = defaultLogger(config.LogFormat)
+	}
+	if p.transformer == nil {
+		p.transformer = nopTransformer{}
+	}
+	p.setLive(newSettings(config, nil))
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.clientDict = newClientDict(p.disconnected)
+	p.bufPool.New = func() interface{} {
+		buf := make([]byte, p.config.BufferSize)
+		return &buf
+	}
+	p.setupDrop()
+	return p
+}
+
+// Bind the proxy socket, resolve the servers and start relaying in the
+// background. The proxy is closed when ctx is cancelled.
+func (p *Proxy) Start(ctx context.Context) error {
+	if err := p.config.Validate(); err != nil {
+		return err
+	}
+	p.psk, _ = newPSK(p.config.PSK)
+	p.firstPrefix, _ = hex.DecodeString(p.config.RequirePrefix)
+	p.sourceIP = net.ParseIP(p.config.SourceIP)
+	if p.config.LocalPortRange != "" {
+		// Validate has checked it
+		p.portLo, p.portHi, _ = parsePortRange(p.config.LocalPortRange)
+	}
+	if err := p.setupMulticast(); p.checkreport(LevelError, err) {
+		return err
+	}
+	if p.config.RequireUpstream != "" {
+		if err := p.requireUpstream(ctx); p.checkreport(LevelError, err) {
+			return err
+		}
+	}
+	if p.config.StateFile != "" {
+		if err := p.loadState(); p.checkreport(LevelError, err) {
+			return err
+		}
+	}
+	if err := p.setup(); err != nil {
+		return err
+	}
+	if p.config.IdleTimeout > 0 || p.config.MaxLifetime > 0 {
+		p.relays.Add(1)
+		go p.runReaper(p.config.IdleTimeout, p.config.MaxLifetime)
+	}
+	if p.config.ResolveInterval > 0 && !p.config.Echo {
+		p.relays.Add(1)
+		go p.runResolver(p.config.ResolveInterval)
+	}
+	if p.config.UpstreamKeepalive > 0 && p.ownSockets() && p.config.ServerUnix == "" {
+		p.relays.Add(1)
+		go p.runKeepalive(p.config.UpstreamKeepalive)
+	}
+	if p.config.HealthProbeInterval > 0 && !p.config.Echo {
+		p.relays.Add(1)
+		go p.runHealthProbe(p.config.HealthProbeInterval)
+	}
+	if p.config.StatsInterval > 0 {
+		p.relays.Add(1)
+		go p.runStats(p.config.StatsInterval)
+	}
+	for _, pudp := range p.proxyConns {
+		p.relays.Add(1)
+		go p.runProxy(pudp)
+	}
+	if p.unixConn != nil {
+		p.relays.Add(1)
+		go p.runUnixProxy(p.unixConn)
+	}
+	if p.upstream != nil {
+		p.relays.Add(1)
+		go p.runUpstream()
+	}
+	if p.pool != nil {
+		for i := 0; i < poolWorkers(p.config.ConnWorkers); i++ {
+			p.relays.Add(1)
+			go p.runPoolWorker()
+		}
+	}
+	if p.mirrorConn != nil {
+		p.relays.Add(1)
+		go p.runMirrorDrain()
+	}
+	if p.tcpListener != nil {
+		p.relays.Add(1)
+		go p.runTCPListener(p.tcpListener)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Close()
+		case <-p.ctx.Done():
+		}
+	}()
+	return nil
+}
+
+func (p *Proxy) setup() error {
+	p.Vlogf(LevelDebug, "Proxy port = %d, Server addresses = %s\n",
+		p.config.Port, strings.Join(p.config.Servers, ","))
+
+	// Set up Proxy. With "udp" an empty host listens on :: for dual-stack.
+	network := p.config.Network
+	listen := p.config.Listen
+	if listen == "" {
+		listen = fmt.Sprintf(":%d", p.config.Port)
+	}
+	saddr, err := net.ResolveUDPAddr(network, listen)
+	if p.checkreport(LevelError, err) {
+		return err
+	}
+	if err := checkLocalIP("listen address", saddr.IP); p.checkreport(LevelError, err) {
+		return err
+	}
+	if err := checkLocalIP("source IP", p.sourceIP); p.checkreport(LevelError, err) {
+		return err
+	}
+	if p.config.ListenUnix != "" {
+		if err := p.listenUnix(p.config.ListenUnix); p.checkreport(LevelError, err) {
+			return err
+		}
+		p.Vlogf(LevelInfo, "Proxy serving on unix socket %s\n", p.config.ListenUnix)
+	} else if err := p.listenProxy(network, saddr); err != nil {
+		return err
+	} else if p.config.Listen != "" {
+		p.Vlogf(LevelInfo, "Proxy serving on %s\n", p.proxyConns[0].LocalAddr().String())
+	} else {
+		p.Vlogf(LevelInfo, "Proxy serving on port %d\n", p.config.Port)
+	}
+
+	if p.config.ListenTCP != "" {
+		ln, err := net.Listen("tcp", p.config.ListenTCP)
+		if p.checkreport(LevelError, err) {
+			p.closeListeners()
+			return err
+		}
+		p.tcpListener = ln
+		p.Vlogf(LevelInfo, "Bridging TCP clients on %s\n", ln.Addr().String())
+	}
+
+	// Get server addresses
+	addrs, err := p.resolveServers(p.config.Servers)
+	if p.checkreport(LevelError, err) {
+		p.closeListeners()
+		return err
+	}
+	if p.config.Echo {
+		p.Vlogf(LevelInfo, "Echoing datagrams back to clients\n")
+	} else if p.config.ServerUnix != "" {
+		p.Vlogf(LevelInfo, "Relaying to unix socket %s\n", p.config.ServerUnix)
+	} else if p.config.SingleUpstreamSocket || p.config.Collapse != "" {
+		u, err := p.openUpstream()
+		if p.checkreport(LevelError, err) {
+			p.closeListeners()
+			return err
+		}
+		p.upstream = u
+		p.Vlogf(LevelInfo, "Sharing upstream socket %s among all clients\n",
+			u.conn.LocalAddr().String())
+	}
+	if p.config.ConnModel == "pool" && !havePool {
+		p.Vlogf(LevelError, "Warning: the connection pool is Linux only; reading each server socket on its own routine\n")
+	} else if p.config.ConnModel == "pool" && p.ownSockets() {
+		cp, err := newConnPool()
+		if p.checkreport(LevelError, err) {
+			p.closeListeners()
+			return err
+		}
+		p.pool = cp
+		p.Vlogf(LevelInfo, "Reading server sockets on %d pool workers\n",
+			poolWorkers(p.config.ConnWorkers))
+	}
+	if p.config.Mirror != "" {
+		if err := p.dialMirror(); p.checkreport(LevelError, err) {
+			p.closeListeners()
+			if p.upstream != nil {
+				p.upstream.conn.Close()
+			}
+			return err
+		}
+		p.Vlogf(LevelInfo, "Mirroring client traffic to %s\n", p.config.Mirror)
+	}
+	if p.config.Pcap != "" {
+		c, err := openCapture(p.config.Pcap)
+		if p.checkreport(LevelError, err) {
+			p.closeListeners()
+			if p.upstream != nil {
+				p.upstream.conn.Close()
+			}
+			if p.mirrorConn != nil {
+				p.mirrorConn.Close()
+			}
+			return err
+		}
+		p.pcap = c
+		p.Vlogf(LevelInfo, "Capturing relayed datagrams to %s\n", p.config.Pcap)
+	}
+	for _, hostport := range p.config.Servers {
+		p.Vlogf(LevelInfo, "Connected to server at %s\n", hostport)
+	}
+	s := newSettings(p.config, addrs)
+	p.publish(s)
+	p.logACL(s)
+	atomic.StoreUint32(&p.bound, 1)
+	return nil
+}
+
+// Bind one proxy socket per worker to saddr. Several workers need
+// SO_REUSEPORT, which makes the kernel spread clients across the sockets;
+// where it is unavailable a single socket is bound.
+func (p *Proxy) listenProxy(network string, saddr *net.UDPAddr) error {
+	workers := p.config.Workers
+	if p.config.Batch > 1 && !haveBatch {
+		p.Vlogf(LevelError, "Warning: batch reads are Linux only; reading one datagram at a time\n")
+	}
+	if workers > 1 && !haveReusePort {
+		p.Vlogf(LevelError, "Warning: %d workers need SO_REUSEPORT, which is Linux only; using a single listener\n",
+			workers)
+		workers = 1
+	}
+	lc := net.ListenConfig{}
+	if workers > 1 {
+		lc.Control = reusePortControl
+	}
+	address := saddr.String()
+	// On a wildcard address replies must name their source, or the kernel
+	// may send them from another of the host's addresses
+	p.pktinfo = p.config.PacketInfo || saddr.IP == nil || saddr.IP.IsUnspecified()
+	for i := 0; i < workers; i++ {
+		conn, err := lc.ListenPacket(context.Background(), network, address)
+		err = inUse(saddr.Port, err)
+		if p.checkreport(LevelError, err) {
+			p.closeListeners()
+			return err
+		}
+		pudp := conn.(*net.UDPConn)
+		p.proxyConns = append(p.proxyConns, pudp)
+		if err := p.sizeBuffers(pudp); p.checkreport(LevelError, err) {
+			p.closeListeners()
+			return err
+		}
+		if p.pktinfo {
+			err := enablePacketInfo(pudp)
+			if err != nil && !p.config.PacketInfo {
+				p.Vlogf(LevelInfo, "Replies may leave from any local address: %s\n", err.Error())
+				p.pktinfo = false
+			} else if p.checkreport(LevelError, err) {
+				p.closeListeners()
+				return err
+			}
+		}
+		if p.config.DSCPClient != 0 {
+			err = setDSCP(pudp, p.config.DSCPClient)
+			if p.checkreport(LevelError, err) {
+				p.closeListeners()
+				return err
+			}
+		}
+		if p.config.TTLClient != 0 {
+			err = setTTL(pudp, p.config.TTLClient)
+			if p.checkreport(LevelError, err) {
+				p.closeListeners()
+				return err
+			}
+		}
+		if p.config.DFClient {
+			err = setDF(pudp)
+			if p.checkreport(LevelError, err) {
+				p.closeListeners()
+				return err
+			}
+		}
+		// Later workers join the first on the port it was given
+		address = pudp.LocalAddr().String()
+	}
+	if workers > 1 {
+		p.Vlogf(LevelInfo, "Started %d workers on %s\n", workers, address)
+	}
+	return nil
+}
+
+// Close the proxy sockets and TCP listener opened so far by setup
+func (p *Proxy) closeListeners() {
+	for _, pudp := range p.proxyConns {
+		pudp.Close()
+	}
+	if p.unixConn != nil {
+		p.unixConn.Close()
+		// Unlike a stream listener, a datagram socket leaves its file behind
+		os.Remove(p.config.ListenUnix)
+	}
+	if p.tcpListener != nil {
+		p.tcpListener.Close()
+	}
+}
+
+// Fail unless ip is unspecified or assigned to a local interface, which
+// gives a clearer error than the bind failing. what names ip in the error.
+func checkLocalIP(what string, ip net.IP) error {
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s is not assigned to any local interface", what, ip)
+}
+
+// Routine to handle inputs to one proxy socket. Returns once the proxy is
+// closed.
+func (p *Proxy) runProxy(pudp *net.UDPConn) {
+	defer p.relays.Done()
+	if p.config.Batch > 1 && haveBatch {
+		p.runProxyBatch(pudp)
+		return
+	}
+	var oob []byte
+	if p.pktinfo {
+		oob = newPacketInfoBuffer()
+	}
+	for {
+		bufp := p.bufPool.Get().(*[]byte)
+		ok := p.relayFromClient(pudp, *bufp, oob)
+		p.bufPool.Put(bufp)
+		if !ok {
+			return
+		}
+	}
+}
+
+// Pause after a transient read error on a listening socket
+const readErrorBackoff = 10 * time.Millisecond
+
+// Pause after a transient read error so a socket that keeps failing does
+// not pin a CPU. Returns false if the proxy stops meanwhile.
+func (p *Proxy) readBackoff() bool {
+	t := time.NewTimer(readErrorBackoff)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// Read one datagram from a client on pudp and relay it to that client's
+// server. oob receives the destination address when PacketInfo is set.
+// Returns false once the proxy is closed.
+func (p *Proxy) relayFromClient(pudp *net.UDPConn, buffer, oob []byte) bool {
+	n, oobn, flags, cliaddr, err := pudp.ReadMsgUDP(buffer, oob)
+	if errors.Is(err, net.ErrClosed) || err != nil && p.stopping() {
+		return false
+	}
+	if p.checkreport(LevelError, err) {
+		return p.readBackoff()
+	}
+	return p.relayClientDatagram(pudp, cliaddr, buffer, n, oob[:oobn], flags)
+}
+
+// Relay the n byte datagram read from cliaddr on pudp into buffer, given the
+// control messages and flags it was read with. Returns false once the proxy
+// is closed.
+func (p *Proxy) relayClientDatagram(pudp *net.UDPConn, cliaddr *net.UDPAddr, buffer []byte, n int, oob []byte, flags int) bool {
+	saddr := cliaddr.String()
+	fields := Fields{Client: saddr, Bytes: n, area: areaProxy}
+	if p.logs(LevelDebug, fields.area) {
+		p.Vlogs(LevelDebug, "read from client", fields, "Read %s from client %s\n",
+			p.payload(buffer[0:n]), saddr)
+	}
+	p.dumpPayload(fields, buffer[0:n])
+	if flags&msgTrunc != 0 {
+		p.warnTruncated(true)
+		p.countDrop(dropOversize)
+		p.Vlogs(LevelInfo, "dropped truncated datagram from client", fields,
+			"Dropped datagram from client %s larger than the %d byte buffer\n",
+			saddr, len(buffer))
+		return true
+	}
+	if !haveMsgTrunc && n == len(buffer) {
+		p.warnTruncated(false)
+		p.Vlogs(LevelInfo, "datagram from client may be truncated", fields,
+			"Warning: datagram from client %s filled the %d byte buffer and may be truncated\n",
+			saddr, n)
+	}
+	key, local := saddr, pudp.LocalAddr()
+	if p.config.KeyByIP {
+		key = (&net.IPAddr{IP: cliaddr.IP, Zone: cliaddr.Zone}).String()
+	}
+	var reply []byte
+	if dst := packetDst(oob); len(oob) > 0 && dst != nil {
+		// Answer from the address the client sent to and, with PacketInfo,
+		// keep clients of different local addresses apart
+		if p.config.PacketInfo {
+			key += "," + dst.String()
+		}
+		local = &net.UDPAddr{IP: dst, Port: local.(*net.UDPAddr).Port}
+		reply = replyPacketInfo(cliaddr, dst)
+	}
+	return p.relayDatagram(key, cliaddr, pudp, local, reply, buffer[0:n], fields)
+}
+
+// Relay data from the datagram client at cliaddr, keyed by key, to its
+// server, creating its connection if this is the first datagram. pc is the
+// socket data came in on, which replies go out on, and local the address
+// the client sent to. Replies carry the control message reply, if any.
+// Returns false once the proxy is closed.
+func (p *Proxy) relayDatagram(key string, cliaddr net.Addr, pc net.PacketConn, local net.Addr, reply, data []byte, fields Fields) bool {
+	// Authenticate before a connection is made for the client
+	if data = p.decryptFromClient(data, fields); data == nil {
+		return true
+	}
+	data, bufp := p.unpackFrom(p.clientCodec, "client", data, fields)
+	if data == nil {
+		return true
+	}
+	defer p.clientCodec.release(bufp)
+	if p.oversized(data, fields) {
+		return true
+	}
+	s := p.current()
+	shard := p.clientDict.shard(key)
+	shard.dlock()
+	shard.awaitDial(key)
+	if p.stopping() {
+		// Close has already closed the existing connections
+		shard.dunlock()
+		return false
+	}
+	var header []byte
+	admitted := false
+	conn, found := shard.conns[key]
+	if !found {
+		// Connections made before a reload of the lists keep flowing
+		if !s.allowedAddr(cliaddr) {
+			shard.dunlock()
+			p.countDrop(dropDenylist)
+			p.Vlogs(LevelVerbose, "refused packet from client", fields,
+				"Refused packet from client %s\n", fields.Client)
+			return true
+		}
+		if !p.validFirstPacket(data, fields) {
+			shard.dunlock()
+			return true
+		}
+		// Every other check a datagram can fail runs before the server is
+		// dialed too, so one that would be dropped costs no socket. The
+		// transformer runs unlocked, as for any other datagram.
+		shard.dunlock()
+		if data = p.admitFromClient(s, data, fields); data == nil {
+			return true
+		}
+		admitted = true
+		shard.dlock()
+		shard.awaitDial(key)
+		if p.stopping() {
+			shard.dunlock()
+			return false
+		}
+		conn, found = shard.conns[key]
+	}
+	if !found {
+		// The connection limits are the last checks, made as it is added
+		conn = p.addConnection(shard, s, key, cliaddr)
+		if conn == nil {
+			shard.dunlock()
+			return true
+		}
+		conn.replyConn = pc
+		conn.replyOOB = reply
+		shard.dunlock()
+		fields.Conn = conn.ID
+		p.logNewConnection(conn, "", fields)
+		p.connected(conn)
+		if p.config.ProxyProtocol {
+			// Only the routine that created conn gets here, so the
+			// header goes out exactly once
+			header = proxyHeader(cliaddr, local, false)
+		}
+		// Start reading replies, unless they all come in on the shared
+		// upstream socket
+		if p.ownSockets() {
+			p.readServer(conn)
+		}
+	} else {
+		fields.Conn = conn.ID
+		p.Vlogs(LevelTrace, "found connection", fields,
+			"Found connection for client %s\n", fields.Client)
+		atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
+		if p.config.KeyByIP && conn.client().String() != cliaddr.String() {
+			// Replies follow the client to its latest port
+			conn.setClient(cliaddr)
+		}
+		shard.dunlock()
+	}
+	if !admitted {
+		p.forwardToServer(s, conn, header, data, fields)
+		return true
+	}
+	// A new connection's bucket always has a token for its first datagram
+	if !p.rateLimited(conn, fields) {
+		p.sendFromClient(s, conn, header, data, fields)
+	}
+	return true
+}
+
+// Report whether the first datagram of a new client is long enough and
+// starts with RequirePrefix, logging it if not. No state is created for a
+// client whose first datagram fails, so a spoofed datagram cannot make the
+// proxy dial a server.
+func (p *Proxy) validFirstPacket(data []byte, fields Fields) bool {
+	if len(data) >= p.config.MinFirstPacket && bytes.HasPrefix(data, p.firstPrefix) {
+		return true
+	}
+	p.countDrop(dropPolicy)
+	p.Vlogs(LevelVerbose, "refused first packet from client", fields,
+		"Dropped first packet from new client %s, %d bytes failing the first packet check\n",
+		fields.Client, len(data))
+	return false
+}
+
+// Report, and log, whether a client datagram is larger than MaxPacket
+func (p *Proxy) oversized(data []byte, fields Fields) bool {
+	if max := p.config.MaxPacket; max == 0 || len(data) <= max {
+		return false
+	}
+	p.countDrop(dropOversize)
+	p.Vlogs(LevelDebug, "dropped oversized packet from client", fields,
+		"Dropped %d byte packet from client %s, larger than the %d byte limit\n",
+		len(data), fields.Client, p.config.MaxPacket)
+	return true
+}
+
+// Create a connection for cliaddr and insert it into shard d under key.
+// Returns nil if the proxy is draining or closing, the connection limit has
+// been reached or the server could not be dialed. Caller must hold the
+// dmutex of d. It is released while the server is dialed, so other clients
+// of the shard are not held up, with key marked as dialing meanwhile for
+// awaitDial.
+func (p *Proxy) addConnection(d *dictShard, s *settings, key string, cliaddr net.Addr) *Connection {
+	// Checked with the dmutex held, like the connection limit
+	if p.Draining() {
+		p.countDrop(dropPolicy)
+		p.Vlogs(LevelVerbose, "refused new client while draining", Fields{Client: cliaddr.String()},
+			"Dropped packet from new client %s, draining\n", cliaddr.String())
+		return nil
+	}
+	// Reserving before dialing keeps concurrent shards from overshooting
+	n := atomic.AddInt64(&p.connCount, 1)
+	if max := p.config.MaxConnections; max > 0 && n > int64(max) {
+		atomic.AddInt64(&p.connCount, -1)
+		p.countDrop(dropPolicy)
+		p.Vlogs(LevelInfo, "connection limit reached", Fields{Client: cliaddr.String()},
+			"Dropped packet from new client %s, %d connections already open\n",
+			cliaddr.String(), max)
+		return nil
+	}
+	subnet, ok := p.reserveSubnet(cliaddr)
+	if !ok {
+		atomic.AddInt64(&p.connCount, -1)
+		return nil
+	}
+	done := make(chan struct{})
+	d.dialing[key] = done
+	d.dunlock()
+	conn := p.newConnection(s, key, cliaddr)
+	d.dlock()
+	delete(d.dialing, key)
+	close(done)
+	if conn != nil && p.stopping() {
+		// Close has already removed every connection it could see
+		conn.closeServer()
+		conn.c2sDelay.close()
+		conn.s2cDelay.close()
+		conn = nil
+	}
+	if conn == nil {
+		atomic.AddInt64(&p.connCount, -1)
+		p.releaseSubnet(subnet)
+		return nil
+	}
+	conn.subnet = subnet
+	d.conns[key] = conn
+	conn.metrics.Store(p.attachMetrics(p.serverLabel(s, conn.ServerAddr)))
+	return conn
+}
+
+// Apply the per-client policies to a datagram from conn's client and, if it
+// survives them, write it to conn's server preceded by header, if any.
+// Reports whether the datagram carrying header was written or queued.
+func (p *Proxy) forwardToServer(s *settings, conn *Connection, header, data []byte, fields Fields) bool {
+	if p.rateLimited(conn, fields) {
+		return false
+	}
+	if data = p.admitFromClient(s, data, fields); data == nil {
+		return false
+	}
+	return p.sendFromClient(s, conn, header, data, fields)
+}
+
+// Report whether a datagram from conn's client is over its rate, logging
+// and counting it as dropped if so
+func (p *Proxy) rateLimited(conn *Connection, fields Fields) bool {
+	if l := conn.rateLimiter(); l == nil || l.Allow() {
+		return false
+	}
+	p.countDrop(dropRateLimit)
+	p.Vlogs(LevelVerbose, "rate limited packet from client", fields,
+		"Rate limited packet from client %s\n", fields.Client)
+	return true
+}
+
+// Apply the drop rate and transformer to a datagram from a client,
+// returning the datagram to relay or nil if it is dropped. Needs no
+// connection, so a new client's first datagram passes it before one is made.
+func (p *Proxy) admitFromClient(s *settings, data []byte, fields Fields) []byte {
+	if p.dropPacket(s) {
+		p.countDrop(dropPolicy)
+		p.Vlogs(LevelVerbose, "dropped packet from client", fields,
+			"Dropped packet from client %s\n", fields.Client)
+		return nil
+	}
+	p.logChecksum(fields, "from client, before transform", data)
+	if data = p.transformer.ClientToServer(data); data == nil {
+		p.countDrop(dropPolicy)
+		p.Vlogs(LevelVerbose, "transformer dropped packet from client", fields,
+			"Transformer dropped packet from client %s\n", fields.Client)
+		return nil
+	}
+	p.logChecksum(fields, "to server, after transform", data)
+	return data
+}
+
+// Write a datagram from conn's client that has passed the policies to its
+// server, preceded by header, if any, or back to the client in echo mode.
+// Reports whether the datagram carrying header was written or queued.
+func (p *Proxy) sendFromClient(s *settings, conn *Connection, header, data []byte, fields Fields) bool {
+	if p.config.Echo {
+		// Reflect the datagram as if the server had sent it straight back
+		p.countC2S(conn, len(data))
+		p.forwardToClient(conn, data, fields)
+		return true
+	}
+	payload := data
+	if header != nil {
+		data = append(header, data...)
+	}
+	copies := 1
+	if p.dupPacket(s) {
+		copies = 2
+		p.Vlogs(LevelTrace, "duplicated packet from client", fields,
+			"Duplicated packet from client %s\n", fields.Client)
+	}
+	sent := false
+	for i := 0; i < copies; i++ {
+		// The server is told about the client once, so only the first
+		// copy carries the header
+		if i > 0 {
+			data = payload
+		}
+		// The delay queue copies data, and a direct send is done with it
+		// before the buffer goes back to the pool, so both copies can share it
+		p.throttle(conn.c2sBandwidth, len(data))
+		ok := true
+		if conn.c2sDelay != nil {
+			p.delay(conn.c2sDelay, data, len(data)-len(payload), fields)
+		} else {
+			ok = p.sendToServer(conn, data, payload, fields)
+		}
+		if i == 0 {
+			sent = ok
+		}
+	}
+	return sent
+}
+
+// Write a datagram from conn's client to its server, and payload, the part
+// of it after any PROXY header, to the mirror. Reports whether it was written.
+func (p *Proxy) sendToServer(conn *Connection, data, payload []byte, fields Fields) bool {
+	var err error
+	if p.upstream != nil {
+		p.armWrite(p.upstream.conn)
+		err = p.upstream.send(conn, p.serverCodec.pack(data))
+	} else {
+		err = p.writeToServer(conn, data)
+	}
+	return p.sentToServer(conn, data, payload, fields, err)
+}
+
+// Send datagrams released by conn's delay queue towards the server, in one
+// batch where the platform and configuration allow
+func (p *Proxy) sendDelayedToServer(conn *Connection, due []delayed) {
+	if haveBatch && p.config.Batch > 1 && len(due) > 1 && p.upstream == nil && conn.ServerUnix == nil {
+		errs := p.writeBatchToServer(conn, due)
+		for i, d := range due {
+			p.sentToServer(conn, d.data, d.data[d.skip:], d.fields, errs[i])
+		}
+		return
+	}
+	for _, d := range due {
+		p.sendToServer(conn, d.data, d.data[d.skip:], d.fields)
+	}
+}
+
+// Account for a datagram written to conn's server with result err, and
+// copy its payload to the mirror. Reports whether err is nil.
+func (p *Proxy) sentToServer(conn *Connection, data, payload []byte, fields Fields, err error) bool {
+	if err == errConnectionClosed {
+		p.Vlogs(LevelVerbose, "dropped packet for closed connection", fields,
+			"Dropped packet from client %s, connection closed\n", fields.Client)
+		return false
+	}
+	p.mirror(payload, fields)
+	if errors.Is(err, syscall.EMSGSIZE) {
+		p.countDrop(dropMsgSize)
+		mtu := 0
+		if srvudp := conn.serverConn(); srvudp != nil {
+			mtu = pathMTU(srvudp)
+		}
+		p.checkreportFields(LevelError, fields, mtuError("client "+fields.Client, "server "+conn.server().String(), len(data), mtu))
+		return false
+	}
+	if isTimeout(err) {
+		p.Vlogs(LevelVerbose, "write to server timed out", fields,
+			"Dropped packet from client %s, write timed out\n", fields.Client)
+		return false
+	}
+	if p.checkreportFields(LevelError, fields, err) {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			p.serverRefused(conn)
+		}
+		return false
+	}
+	p.countC2S(conn, len(data))
+	if p.config.UpstreamKeepalive > 0 {
+		atomic.StoreInt64(&conn.lastC2S, time.Now().UnixNano())
+	}
+	p.rttSent(conn)
+	p.capture(conn.client(), conn.server(), data)
+	return true
+}
+
+// Address clients reach the proxy at, such as the port picked for a zero
+// Port, or its unix socket with ListenUnix. Nil until Start has bound it.
+func (p *Proxy) Addr() net.Addr {
+	if atomic.LoadUint32(&p.bound) == 0 {
+		return nil
+	}
+	if p.unixConn != nil {
+		return p.unixConn.LocalAddr()
+	}
+	return p.proxyConns[0].LocalAddr()
+}
+
+// Report whether the proxy socket is bound and the proxy is not shutting down
+func (p *Proxy) Healthy() bool {
+	return atomic.LoadUint32(&p.bound) == 1 && !p.stopping()
+}
+
+// Report whether the proxy is healthy, not draining and has at least one
+// resolved server, or needs none in echo mode
+func (p *Proxy) Ready() bool {
+	return p.Healthy() && !p.Draining() &&
+		(p.config.Echo || p.config.ServerUnix != "" || len(p.current().serverAddrs) > 0)
+}
+
+// Report whether the proxy is shutting down
+func (p *Proxy) stopping() bool {
+	return p.ctx.Err() != nil
+}
+
+// Error returned by Close when the routines fail to finish in time
+var ErrShutdownTimeout = errors.New("proxy: shutdown timed out")
+
+// Error returned by Start when the address to listen on is already bound,
+// most likely by another proxy
+type AddrInUseError struct {
+	Port int   // Port that could not be bound
+	Err  error // Error from the bind
+}
+
+func (e *AddrInUseError) Error() string {
+	return fmt.Sprintf("port %d already in use; another proxy may be running", e.Port)
+}
+
+func (e *AddrInUseError) Unwrap() error { return e.Err }
+
+// Wrap err in an AddrInUseError for port if it is a bind failing on an
+// address already in use
+func inUse(port int, err error) error {
+	if addrInUse(err) {
+		return &AddrInUseError{Port: port, Err: err}
+	}
+	return err
+}
+
+// Close the proxy and server sockets so every relay loop returns, then wait
+// up to the configured shutdown timeout for the routines to finish.
+func (p *Proxy) Close() error {
+	p.closeOnce.Do(func() {
+		p.cancel()
+		p.closeListeners()
+		if p.upstream != nil {
+			p.upstream.conn.Close()
+		}
+		if p.mirrorConn != nil {
+			p.mirrorConn.Close()
+		}
+		if p.config.StateFile != "" {
+			p.checkreport(LevelError, p.saveState())
+		}
+		p.clientDict.each(p.removeConnection)
+		if p.pcap != nil {
+			p.checkreport(LevelError, p.pcap.close())
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		p.relays.Wait()
+		if p.pool != nil {
+			p.pool.close()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(p.config.ShutdownTimeout):
+		p.Vlogf(LevelError, "Shutdown timed out after %s\n", p.config.ShutdownTimeout)
+		return ErrShutdownTimeout
+	}
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import "testing"
+
+// Keeps benchmarked buffers from being optimised away
+var sinkBuffer []byte
+
+// Per-datagram buffers allocated afresh, as before the pool, against
+// buffers taken from and returned to bufPool as the read loops do
+func BenchmarkBuffers(b *testing.B) {
+	p := New(Config{})
+	datagram := make([]byte, 512)
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := make([]byte, p.config.BufferSize)
+			copy(buf, datagram)
+			sinkBuffer = buf
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bufp := p.bufPool.Get().(*[]byte)
+			copy(*bufp, datagram)
+			sinkBuffer = *bufp
+			p.bufPool.Put(bufp)
+		}
+	})
+}
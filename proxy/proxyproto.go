@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Signature opening every PROXY protocol v2 header
+var ppv2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 address family and transport bytes
+const (
+	ppv2Proxy  = 0x21 // Version 2, PROXY command
+	ppv2Inet   = 0x10
+	ppv2Inet6  = 0x20
+	ppv2Unix   = 0x30
+	ppv2Stream = 0x01
+	ppv2Dgram  = 0x02
+)
+
+// Length of each address in a PROXY protocol v2 AF_UNIX block
+const ppv2UnixLen = 108
+
+// Build a PROXY protocol v2 header telling the server that src connected
+// to dst. stream is true when the client reached the proxy over TCP.
+func proxyHeader(src, dst net.Addr, stream bool) []byte {
+	if _, ok := src.(*net.UnixAddr); ok {
+		return proxyUnixHeader(src, dst)
+	}
+	srcIP, srcPort := addrIPPort(src)
+	dstIP, dstPort := addrIPPort(dst)
+	fam := byte(ppv2Inet6)
+	if src4 := srcIP.To4(); src4 != nil {
+		// A v4 client on a dual-stack socket is described as v4 throughout
+		fam = ppv2Inet
+		srcIP = src4
+		dstIP = dstIP.To4()
+		if dstIP == nil {
+			dstIP = net.IPv4zero.To4()
+		}
+	} else {
+		srcIP = srcIP.To16()
+		dstIP = dstIP.To16()
+		if dstIP == nil {
+			dstIP = net.IPv6zero
+		}
+	}
+	proto := byte(ppv2Dgram)
+	if stream {
+		proto = ppv2Stream
+	}
+
+	alen := 2*len(srcIP) + 4
+	hdr := make([]byte, 0, len(ppv2Signature)+4+alen)
+	hdr = append(hdr, ppv2Signature...)
+	hdr = append(hdr, ppv2Proxy, fam|proto)
+	hdr = append(hdr, byte(alen>>8), byte(alen))
+	hdr = append(hdr, srcIP...)
+	hdr = append(hdr, dstIP...)
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dstPort))
+	return append(hdr, ports[:]...)
+}
+
+// IP and port of a UDP or TCP address
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// Build a PROXY protocol v2 header for a unix datagram client. Paths are
+// NUL padded, and truncated if longer than the block allows.
+func proxyUnixHeader(src, dst net.Addr) []byte {
+	hdr := make([]byte, 0, len(ppv2Signature)+4+2*ppv2UnixLen)
+	hdr = append(hdr, ppv2Signature...)
+	hdr = append(hdr, ppv2Proxy, ppv2Unix|ppv2Dgram)
+	hdr = append(hdr, byte(2*ppv2UnixLen>>8), byte(2*ppv2UnixLen&0xff))
+	for _, addr := range []net.Addr{src, dst} {
+		var path [ppv2UnixLen]byte
+		copy(path[:], addr.String())
+		hdr = append(hdr, path[:]...)
+	}
+	return hdr
+}
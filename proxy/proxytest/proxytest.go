@@ -0,0 +1,164 @@
+// Package proxytest runs a proxy on a loopback port in front of echo
+// servers of its own, for tests that relay real datagrams through it.
+//
+// A regression test starts an Env with the configuration under test, sends
+// through it and checks what comes back:
+//
+//	env, err := proxytest.New(proxy.Config{IdleTimeout: time.Second}, 2)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer env.Close()
+//	reply, err := env.RoundTrip(env.Client, []byte("ping"))
+//	if err != nil || string(reply) != "ping" {
+//		t.Fatalf("got %q, %v", reply, err)
+//	}
+//
+// Each client from NewClient has a port of its own, so gets a connection
+// of its own and, with several servers, is balanced like any other client.
+// A datagram lost to DropRate, or to a server that is never reached, shows
+// as a RoundTrip timing out after Timeout, and each EchoServer counts what
+// reaches it.
+package proxytest
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/annlumia/udp-proxy/proxy"
+)
+
+// How long RoundTrip waits for a reply unless Env.Timeout says otherwise
+const DefaultTimeout = time.Second
+
+// UDP server on a loopback port answering every datagram with its payload
+type EchoServer struct {
+	received int64 // Datagrams read, updated atomically
+
+	Conn *net.UDPConn
+}
+
+// Start an echo server on an ephemeral loopback port
+func NewEchoServer() (*EchoServer, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	s := &EchoServer{Conn: conn}
+	go s.serve()
+	return s, nil
+}
+
+// Answer datagrams until the server is closed
+func (s *EchoServer) serve() {
+	buffer := make([]byte, proxy.MaxUDPPayload)
+	for {
+		n, addr, err := s.Conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.received, 1)
+		s.Conn.WriteToUDP(buffer[:n], addr)
+	}
+}
+
+// Address of the server as host:port
+func (s *EchoServer) Addr() string {
+	return s.Conn.LocalAddr().String()
+}
+
+// Number of datagrams the server has read
+func (s *EchoServer) Received() int {
+	return int(atomic.LoadInt64(&s.received))
+}
+
+// Stop the server
+func (s *EchoServer) Close() error {
+	return s.Conn.Close()
+}
+
+// A started proxy, the echo servers behind it and a client connected to it
+type Env struct {
+	Proxy   *proxy.Proxy
+	Servers []*EchoServer
+	Client  *net.UDPConn  // First client, from NewClient
+	Timeout time.Duration // How long RoundTrip waits for a reply
+
+	clients []*net.UDPConn
+}
+
+// Start servers echo servers and a proxy relaying to them with config,
+// listening on an ephemeral loopback port. Servers in config, or Echo,
+// take the place of the echo servers, as do servers of 0. Listen and Port
+// are overridden.
+func New(config proxy.Config, servers int) (*Env, error) {
+	env := &Env{Timeout: DefaultTimeout}
+	if len(config.Servers) == 0 && !config.Echo {
+		for i := 0; i < servers; i++ {
+			s, err := NewEchoServer()
+			if err != nil {
+				env.Close()
+				return nil, err
+			}
+			env.Servers = append(env.Servers, s)
+			config.Servers = append(config.Servers, s.Addr())
+		}
+	}
+	config.Listen = "127.0.0.1:0"
+	config.Port = 0
+	env.Proxy = proxy.New(config)
+	if err := env.Proxy.Start(context.Background()); err != nil {
+		env.Proxy = nil
+		env.Close()
+		return nil, err
+	}
+	client, err := env.NewClient()
+	if err != nil {
+		env.Close()
+		return nil, err
+	}
+	env.Client = client
+	return env, nil
+}
+
+// Open another client socket connected to the proxy, closed with env
+func (env *Env) NewClient() (*net.UDPConn, error) {
+	client, err := net.DialUDP("udp", nil, env.Proxy.Addr().(*net.UDPAddr))
+	if err != nil {
+		return nil, err
+	}
+	env.clients = append(env.clients, client)
+	return client, nil
+}
+
+// Send data from client and wait up to Timeout for the datagram that
+// comes back
+func (env *Env) RoundTrip(client *net.UDPConn, data []byte) ([]byte, error) {
+	if _, err := client.Write(data); err != nil {
+		return nil, err
+	}
+	client.SetReadDeadline(time.Now().Add(env.Timeout))
+	buffer := make([]byte, proxy.MaxUDPPayload)
+	n, err := client.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
+
+// Close the clients, the proxy and the echo servers
+func (env *Env) Close() error {
+	for _, client := range env.clients {
+		client.Close()
+	}
+	var err error
+	if env.Proxy != nil {
+		err = env.Proxy.Close()
+	}
+	for _, s := range env.Servers {
+		s.Close()
+	}
+	return err
+}
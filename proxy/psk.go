@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// Bytes of AES-256 key in Config.PSK, which holds them hex encoded
+const PSKSize = 32
+
+// Seals the client leg with AES-256-GCM. Each datagram, or TCP frame
+// payload, between client and proxy travels as
+//
+//	nonce (12 bytes) || ciphertext || tag (16 bytes)
+//
+// with a fresh random nonce per datagram and no additional data, so it is
+// 28 bytes longer than the plaintext relayed to the server.
+//
+// There is no replay protection: nonces are not remembered and datagrams
+// carry no sequence number, so a captured datagram opens again each time it
+// is resent, in either direction. Protocols that cannot tolerate replayed
+// datagrams must detect them themselves.
+type pskCipher struct {
+	aead cipher.AEAD
+}
+
+// Build the cipher for a hex encoded key, nil if key is empty
+func newPSK(key string) (*pskCipher, error) {
+	if key == "" {
+		return nil, nil
+	}
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex: %v", err)
+	}
+	if len(raw) != PSKSize {
+		return nil, fmt.Errorf("key is %d bytes, want %d", len(raw), PSKSize)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pskCipher{aead: aead}, nil
+}
+
+// Encrypt data into a new nonce || ciphertext || tag slice
+func (c *pskCipher) seal(data []byte) ([]byte, error) {
+	size := c.aead.NonceSize()
+	out := make([]byte, size, size+len(data)+c.aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(out, out, data, nil), nil
+}
+
+// Bytes seal adds to a datagram
+func (c *pskCipher) overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+// Decrypt a nonce || ciphertext || tag datagram in place. Returns nil if it
+// is too short or fails authentication.
+func (c *pskCipher) open(data []byte) []byte {
+	size := c.aead.NonceSize()
+	if len(data) < size+c.aead.Overhead() {
+		return nil
+	}
+	plain, err := c.aead.Open(data[size:size], data[:size], data[size:], nil)
+	if err != nil {
+		return nil
+	}
+	return plain
+}
+
+// Decrypt a datagram from a client when PSK is set, logging and returning
+// nil if it fails authentication
+func (p *Proxy) decryptFromClient(data []byte, fields Fields) []byte {
+	if p.psk == nil {
+		return data
+	}
+	plain := p.psk.open(data)
+	if plain == nil {
+		p.countDrop(dropPolicy)
+		p.Vlogs(LevelInfo, "dropped unauthenticated packet", fields,
+			"Dropped packet from client %s that failed authentication\n", fields.Client)
+	}
+	return plain
+}
@@ -0,0 +1,157 @@
+package proxy_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/annlumia/udp-proxy/proxy"
+	"github.com/annlumia/udp-proxy/proxy/proxytest"
+)
+
+// A client datagram over MaxPacket is dropped and counted, while one at
+// the limit is relayed. The buffer holds the whole datagram, so it is the
+// limit and not truncation that drops it.
+func TestMaxPacket(t *testing.T) {
+	env, err := proxytest.New(proxy.Config{MaxPacket: 1200, BufferSize: 16384}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	env.Timeout = 200 * time.Millisecond
+
+	if got, err := env.RoundTrip(env.Client, make([]byte, 9000)); err == nil {
+		t.Fatalf("got a %d byte reply to a 9000 byte datagram, want it dropped", len(got))
+	}
+	if n := env.Servers[0].Received(); n != 0 {
+		t.Fatalf("server received %d datagrams, want 0", n)
+	}
+	if n := env.Proxy.Dropped("oversize"); n != 1 {
+		t.Fatalf("%d oversize drops counted, want 1", n)
+	}
+
+	data := bytes.Repeat([]byte{'x'}, 1200)
+	env.Timeout = proxytest.DefaultTimeout
+	if got, err := env.RoundTrip(env.Client, data); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, %v, want the 1200 byte datagram back", len(got), err)
+	}
+}
+
+// Every datagram is dropped at DropRate 1, before a connection is made for
+// the client, and none at DropRate 0
+func TestDropRate(t *testing.T) {
+	for _, tt := range []struct {
+		rate    float64
+		relayed bool
+	}{
+		{0, true},
+		{1, false},
+	} {
+		env, err := proxytest.New(proxy.Config{DropRate: tt.rate}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.Timeout = 200 * time.Millisecond
+		for i := 0; i < 5; i++ {
+			got, err := env.RoundTrip(env.Client, []byte("ping"))
+			if relayed := err == nil && string(got) == "ping"; relayed != tt.relayed {
+				t.Errorf("drop rate %g: datagram %d got %q, %v", tt.rate, i, got, err)
+			}
+		}
+		want, drops, conns := 5, uint64(0), 1
+		if !tt.relayed {
+			want, drops, conns = 0, 5, 0
+		}
+		if n := env.Servers[0].Received(); n != want {
+			t.Errorf("drop rate %g: server received %d datagrams, want %d", tt.rate, n, want)
+		}
+		if n := env.Proxy.Dropped("policy"); n != drops {
+			t.Errorf("drop rate %g: %d policy drops counted, want %d", tt.rate, n, drops)
+		}
+		if n := len(env.Proxy.Connections()); n != conns {
+			t.Errorf("drop rate %g: %d connections, want %d", tt.rate, n, conns)
+		}
+		env.Close()
+	}
+}
+
+// IdleTimeout closes a connection without traffic but not one in use, and
+// the client's next datagram opens a new connection
+func TestIdleTimeout(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	env, err := proxytest.New(proxy.Config{IdleTimeout: idle}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	roundTrip := func() uint64 {
+		t.Helper()
+		if got, err := env.RoundTrip(env.Client, []byte("ping")); err != nil || string(got) != "ping" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+		conns := env.Proxy.Connections()
+		if len(conns) != 1 {
+			t.Fatalf("%d connections, want 1", len(conns))
+		}
+		return conns[0].ID
+	}
+
+	first := roundTrip()
+	for end := time.Now().Add(2 * idle); time.Now().Before(end); {
+		time.Sleep(idle / 4)
+		if id := roundTrip(); id != first {
+			t.Fatalf("connection %d replaced by %d while in use", first, id)
+		}
+	}
+	waitFor(t, "the idle connection to close", func() bool {
+		return len(env.Proxy.Connections()) == 0
+	})
+	if id := roundTrip(); id == first {
+		t.Fatalf("connection %d reused after closing idle", id)
+	}
+}
+
+// Clients are spread over the servers round-robin, and each stays with its
+// server
+func TestMultipleServers(t *testing.T) {
+	const servers, clients, rounds = 3, 6, 4
+	env, err := proxytest.New(proxy.Config{}, servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	all := []*net.UDPConn{env.Client}
+	for len(all) < clients {
+		c, err := env.NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, c)
+	}
+
+	pinned := make(map[string]string)
+	for round := 0; round < rounds; round++ {
+		for i, c := range all {
+			data := []byte(fmt.Sprintf("client %d round %d", i, round))
+			if got, err := env.RoundTrip(c, data); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("client %d: got %q, %v", i, got, err)
+			}
+		}
+		for _, info := range env.Proxy.Connections() {
+			if server, ok := pinned[info.Client]; ok && server != info.Server {
+				t.Fatalf("client %s moved from %s to %s", info.Client, server, info.Server)
+			}
+			pinned[info.Client] = info.Server
+		}
+	}
+	if len(pinned) != clients {
+		t.Fatalf("%d connections, want %d", len(pinned), clients)
+	}
+	for i, s := range env.Servers {
+		if want := clients / servers * rounds; s.Received() != want {
+			t.Errorf("server %d received %d datagrams, want %d", i, s.Received(), want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Settings that Reload may change. A published value is never modified;
+// Reload and the resolver replace it as a whole so readers always see a
+// consistent set.
+type settings struct {
+	verbosity   [areaCount]int // By area
+	dropRate    float64
+	dupRate     float64
+	rate        float64
+	burst       int
+	servers     []string       // Server entries as configured, weights included
+	serverAddrs []*net.UDPAddr // Resolved from servers
+	allowNets   []*net.IPNet
+	denyNets    []*net.IPNet
+
+	// Picks among serverAddrs by weight, nil for plain round-robin. The
+	// one mutable part of the settings, guarded internally.
+	balancer *weightedRR
+
+	// Maps clients onto serverAddrs with Balance "consistent", else nil
+	ring *hashRing
+}
+
+// Verbosity of each area, Verbosity for those without an AreaVerbosity
+func areaVerbosity(config Config) [areaCount]int {
+	var verbosity [areaCount]int
+	for area := range verbosity {
+		verbosity[area] = config.Verbosity
+	}
+	for name, level := range config.AreaVerbosity {
+		verbosity[areaNames[name]] = level
+	}
+	return verbosity
+}
+
+// Build the reloadable settings from config and resolved server addresses
+func newSettings(config Config, serverAddrs []*net.UDPAddr) *settings {
+	burst := config.Burst
+	if burst == 0 {
+		burst = int(math.Ceil(config.Rate))
+	}
+	s := &settings{
+		verbosity:   areaVerbosity(config),
+		dropRate:    config.DropRate,
+		dupRate:     config.DupRate,
+		rate:        config.Rate,
+		burst:       burst,
+		servers:     config.Servers,
+		serverAddrs: serverAddrs,
+	}
+	// Validate has checked both lists
+	s.allowNets, _ = parseCIDRList(config.Allow)
+	s.denyNets, _ = parseCIDRList(config.Deny)
+	if len(serverAddrs) > 1 {
+		weights := make([]int, len(config.Servers))
+		for i, entry := range config.Servers {
+			_, weights[i], _ = parseServer(entry)
+		}
+		s.balancer = newWeightedRR(weights)
+		if config.Balance == "consistent" {
+			s.ring = newHashRing(config.Servers, weights)
+		}
+	}
+	return s
+}
+
+// Snapshot of the current reloadable settings
+func (p *Proxy) current() *settings {
+	p.cmutex.RLock()
+	defer p.cmutex.RUnlock()
+	return p.live
+}
+
+func (p *Proxy) publish(s *settings) {
+	p.cmutex.Lock()
+	p.setLive(s)
+	p.cmutex.Unlock()
+}
+
+// Make s the live settings. Called with cmutex held, or before Start.
+func (p *Proxy) setLive(s *settings) {
+	p.live = s
+	for area, level := range s.verbosity {
+		atomic.StoreInt32(&p.verbosity[area], int32(level))
+	}
+}
+
+// Publish s in place of old, unless something else has replaced old since
+func (p *Proxy) republish(old, s *settings) bool {
+	p.cmutex.Lock()
+	defer p.cmutex.Unlock()
+	if p.live != old {
+		return false
+	}
+	p.setLive(s)
+	return true
+}
+
+// Publish a copy of the current settings with change applied, retrying if
+// something else replaces them meanwhile
+func (p *Proxy) update(change func(s *settings)) {
+	for {
+		s := p.current()
+		ns := *s
+		change(&ns)
+		if p.republish(s, &ns) {
+			return
+		}
+	}
+}
+
+// Set the verbosity live, as ParseVerbosity returns it, until the next Reload
+func (p *Proxy) SetVerbosity(level int, areas map[string]int) {
+	verbosity := areaVerbosity(Config{Verbosity: level, AreaVerbosity: areas})
+	p.update(func(s *settings) { s.verbosity = verbosity })
+	p.Vlogf(LevelInfo, "Verbosity set to %d\n", level)
+}
+
+// Set the drop rate live until the next Reload
+func (p *Proxy) SetDropRate(rate float64) error {
+	if rate < 0.0 || rate > 1.0 {
+		return fmt.Errorf("drop rate %g out of range 0.0-1.0", rate)
+	}
+	p.update(func(s *settings) { s.dropRate = rate })
+	p.Vlogf(LevelInfo, "Drop rate set to %g\n", rate)
+	return nil
+}
+
+// Go routine which resolves the servers again every interval so new
+// connections follow DNS changes. Existing connections keep their address.
+func (p *Proxy) runResolver(interval time.Duration) {
+	defer p.relays.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s := p.current()
+		addrs, err := p.resolveServers(s.servers)
+		if p.checkreport(LevelError, err) {
+			continue
+		}
+		changed := false
+		for i, addr := range addrs {
+			if old := s.serverAddrs[i].String(); addr.String() != old {
+				p.Vlogf(LevelInfo, "Server %s now resolves to %s, was %s\n",
+					s.servers[i], addr.String(), old)
+				changed = true
+			}
+		}
+		if changed {
+			ns := *s
+			ns.serverAddrs = addrs
+			// Lose the race to Reload, whose list is newer
+			p.republish(s, &ns)
+		}
+	}
+}
+
+// Resolve each host:port in servers, ignoring weights
+func (p *Proxy) resolveServers(servers []string) ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	for _, entry := range servers {
+		hostport, _, err := parseServer(entry)
+		if err != nil {
+			return nil, err
+		}
+		srvaddr, err := net.ResolveUDPAddr(p.config.Network, hostport)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, srvaddr)
+	}
+	return addrs, nil
+}
+
+// Apply the server list, verbosity, drop and duplicate rates, rate limits
+// and allow and deny lists from config to a running proxy. Existing
+// connections keep their server while new ones use the new list, and keep
+// flowing under the new lists unless EnforceACL is set. Changes to settings
+// that need the socket rebound are logged and otherwise ignored.
+func (p *Proxy) Reload(config Config) error {
+	config.setDefaults()
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if config.Port != p.config.Port {
+		p.Vlogf(LevelError, "Warning: port change from %d to %d requires a restart\n",
+			p.config.Port, config.Port)
+	}
+	if config.Listen != p.config.Listen {
+		p.Vlogf(LevelError, "Warning: listen address change from %q to %q requires a restart\n",
+			p.config.Listen, config.Listen)
+	}
+	if config.ListenUnix != p.config.ListenUnix {
+		p.Vlogf(LevelError, "Warning: unix socket change from %q to %q requires a restart\n",
+			p.config.ListenUnix, config.ListenUnix)
+	}
+	if config.Workers != p.config.Workers {
+		p.Vlogf(LevelError, "Warning: workers change from %d to %d requires a restart\n",
+			p.config.Workers, config.Workers)
+	}
+	if config.Network != p.config.Network {
+		p.Vlogf(LevelError, "Warning: network change from %s to %s requires a restart\n",
+			p.config.Network, config.Network)
+	}
+	if config.Collapse != p.config.Collapse {
+		p.Vlogf(LevelError, "Warning: collapse address change from %q to %q requires a restart\n",
+			p.config.Collapse, config.Collapse)
+	}
+	if config.BufferSize != p.config.BufferSize {
+		p.Vlogf(LevelError, "Warning: buffer size change from %d to %d requires a restart\n",
+			p.config.BufferSize, config.BufferSize)
+	}
+	addrs, err := p.resolveServers(config.Servers)
+	if p.checkreport(LevelError, err) {
+		return err
+	}
+	s := newSettings(config, addrs)
+	old := p.current()
+	p.publish(s)
+	p.removeServerMetrics(old.servers, s.servers)
+	p.pruneUnhealthy(s.serverAddrs)
+	p.logACL(s)
+	if config.EnforceACL {
+		p.enforceACL(s)
+	}
+
+	// Existing connections pick up the new limit straight away, including
+	// those created while there was none
+	p.clientDict.each(func(_ *dictShard, _ string, conn *Connection) {
+		conn.setRateLimit(s)
+	})
+	p.Vlogf(LevelInfo, "Reloaded configuration, servers %s\n",
+		strings.Join(config.Servers, ","))
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whether several sockets can share a port with the kernel balancing
+// datagrams between them
+const haveReusePort = true
+
+// net.ListenConfig Control function setting SO_REUSEPORT
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import "syscall"
+
+// SO_REUSEPORT balancing is Linux only, so a single socket is used elsewhere
+const haveReusePort = false
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
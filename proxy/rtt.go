@@ -0,0 +1,46 @@
+package proxy
+
+// RTT probing estimates a connection's round trip as the time from the
+// latest datagram written to its server to the next datagram read back.
+// UDP carries nothing tying a reply to its request, so this is only a
+// coarse heuristic, and is only meaningful for request/response protocols
+// where each client datagram is answered before the next is sent:
+//
+//   - Several requests in flight measure from the last of them, so a
+//     pipelining client reads low.
+//   - A server that sends unprompted, or more than one reply per request,
+//     has only the first datagram after each request counted.
+//   - A request the server drops or ignores is measured against whatever
+//     it sends next, which reads high.
+//   - Delay emulation in either direction is not counted, as requests are
+//     timed when written and replies when read.
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Note the time a datagram was written to conn's server
+func (p *Proxy) rttSent(conn *Connection) {
+	if p.config.RTTProbe {
+		atomic.StoreInt64(&conn.rttSentAt, time.Now().UnixNano())
+	}
+}
+
+// Estimate conn's round trip from a datagram just read from its server, if
+// it is the first since a datagram was written to it
+func (p *Proxy) rttReceived(conn *Connection, fields Fields) {
+	if !p.config.RTTProbe {
+		return
+	}
+	sent := atomic.SwapInt64(&conn.rttSentAt, 0)
+	if sent == 0 {
+		return
+	}
+	rtt := time.Duration(time.Now().UnixNano() - sent)
+	atomic.StoreInt64(&conn.rtt, int64(rtt))
+	m := conn.serverMetrics()
+	m.rtt.Observe(rtt.Seconds())
+	p.Vlogs(LevelTrace, "round trip", fields, "Round trip for client %s to server %s about %s\n",
+		fields.Client, m.server, rtt)
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"syscall"
+)
+
+// A socket whose kernel buffers can be sized
+type bufferedConn interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+	SyscallConn() (syscall.RawConn, error)
+}
+
+// Apply the configured kernel buffer sizes to c, warning the first time
+// the kernel grants less than was asked for
+func (p *Proxy) sizeBuffers(c bufferedConn) error {
+	rcv, snd := p.config.ReadBuffer, p.config.WriteBuffer
+	if rcv > 0 {
+		if err := c.SetReadBuffer(rcv); err != nil {
+			return err
+		}
+	}
+	if snd > 0 {
+		if err := c.SetWriteBuffer(snd); err != nil {
+			return err
+		}
+	}
+	if rcv == 0 && snd == 0 {
+		return nil
+	}
+	gotRcv, gotSnd, ok := socketBuffers(c)
+	if !ok || (gotRcv >= rcv && gotSnd >= snd) {
+		return nil
+	}
+	if atomic.CompareAndSwapUint32(&p.clampWarned, 0, 1) {
+		p.Vlogf(LevelError, "Warning: socket buffers clamped to %d bytes read, %d bytes write; raise net.core.rmem_max and net.core.wmem_max to get %d and %d\n",
+			gotRcv, gotSnd, rcv, snd)
+	}
+	return nil
+}
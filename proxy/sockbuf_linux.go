@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import "golang.org/x/sys/unix"
+
+// Kernel buffer sizes of c as usable for data. Linux reports double the
+// size granted, the extra being bookkeeping overhead.
+func socketBuffers(c bufferedConn) (rcv, snd int, ok bool) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var rerr, serr error
+	err = rc.Control(func(fd uintptr) {
+		rcv, rerr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		snd, serr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	})
+	if err != nil || rerr != nil || serr != nil {
+		return 0, 0, false
+	}
+	return rcv / 2, snd / 2, true
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+// Contents of the state file: the server each client was pinned to when
+// the proxy last shut down. Sockets are not kept, so a client returning
+// after a restart gets a new server socket, but to the same server.
+type savedState struct {
+	Connections []savedConnection `json:"connections"`
+}
+
+type savedConnection struct {
+	Key    string `json:"key"`    // Client dictionary key
+	Server string `json:"server"` // Server the client was pinned to
+}
+
+// Read the server assignments saved by the last shutdown. A missing file
+// is not an error, as there is nothing to restore on a first start.
+func (p *Proxy) loadState() error {
+	data, err := ioutil.ReadFile(p.config.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	restored := make(map[string]string, len(state.Connections))
+	for _, c := range state.Connections {
+		restored[c.Key] = c.Server
+	}
+	p.rsmutex.Lock()
+	p.restored = restored
+	p.rsmutex.Unlock()
+	p.Vlogf(LevelInfo, "Restored %d client server assignments from %s\n",
+		len(restored), p.config.StateFile)
+	return nil
+}
+
+// Write the server every open connection is pinned to, replacing the file
+// in one step so a crash cannot leave half of it behind
+func (p *Proxy) saveState() error {
+	state := savedState{Connections: []savedConnection{}}
+	p.clientDict.each(func(s *dictShard, key string, conn *Connection) {
+		if srv := conn.server(); srv != nil {
+			state.Connections = append(state.Connections, savedConnection{Key: key, Server: srv.String()})
+		}
+	})
+	// Clients that have not come back since the last restart keep theirs
+	p.rsmutex.Lock()
+	for key, server := range p.restored {
+		state.Connections = append(state.Connections, savedConnection{Key: key, Server: server})
+	}
+	p.rsmutex.Unlock()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := p.config.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.config.StateFile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	p.Vlogf(LevelInfo, "Saved %d client server assignments to %s\n",
+		len(state.Connections), p.config.StateFile)
+	return nil
+}
+
+// Server the client keyed by key was pinned to before the restart, if it
+// is still one of the servers. Each assignment is used once; afterwards the
+// client keeps its server through its connection.
+func (p *Proxy) restoredServer(s *settings, key string) *net.UDPAddr {
+	p.rsmutex.Lock()
+	server, found := p.restored[key]
+	delete(p.restored, key)
+	p.rsmutex.Unlock()
+	if !found {
+		return nil
+	}
+	for _, srvAddr := range s.serverAddrs {
+		if srvAddr.String() == server {
+			return srvAddr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Count a datagram of n bytes relayed from conn's client to its server
+func (p *Proxy) countC2S(conn *Connection, n int) {
+	atomic.AddUint64(&conn.c2sPackets, 1)
+	atomic.AddUint64(&conn.c2sBytes, uint64(n))
+	conn.c2sSeen.mark()
+	atomic.AddUint64(&p.totals.C2SPackets, 1)
+	atomic.AddUint64(&p.totals.C2SBytes, uint64(n))
+	m := conn.serverMetrics()
+	m.c2sPackets.Inc()
+	m.c2sBytes.Add(float64(n))
+	p.spendPacket(conn, &conn.c2sBudget, &conn.s2cBudget)
+}
+
+// Reasons a datagram is dropped, counted apart
+const (
+	dropRateLimit = iota // Over the client's Rate
+	dropPolicy           // Refused admission, or dropped by DropRate or the transformer
+	dropOversize         // Over MaxPacket or the buffer
+	dropDenylist         // From a client the allow and deny lists refuse
+	dropMsgSize          // Refused by the kernel as too large to send, EMSGSIZE
+	dropReasons
+)
+
+// Names of the drop reasons, as labelled in metrics and the stats line
+var dropNames = [dropReasons]string{"ratelimit", "policy", "oversize", "denylist", "msgsize"}
+
+// Count a datagram dropped for reason
+func (p *Proxy) countDrop(reason int) {
+	atomic.AddUint64(&p.drops[reason], 1)
+	dropped[reason].Inc()
+}
+
+// Snapshot of the datagrams dropped since Start, by reason
+func (p *Proxy) droppedTotals() [dropReasons]uint64 {
+	var drops [dropReasons]uint64
+	for reason := range drops {
+		drops[reason] = atomic.LoadUint64(&p.drops[reason])
+	}
+	return drops
+}
+
+// Count a datagram of n bytes relayed from conn's server to its client
+func (p *Proxy) countS2C(conn *Connection, n int) {
+	atomic.AddUint64(&conn.s2cPackets, 1)
+	atomic.AddUint64(&conn.s2cBytes, uint64(n))
+	conn.s2cSeen.mark()
+	atomic.AddUint64(&p.totals.S2CPackets, 1)
+	atomic.AddUint64(&p.totals.S2CBytes, uint64(n))
+	m := conn.serverMetrics()
+	m.s2cPackets.Inc()
+	m.s2cBytes.Add(float64(n))
+	p.spendPacket(conn, &conn.s2cBudget, &conn.c2sBudget)
+}
+
+// Snapshot of the traffic relayed by all connections since Start
+func (p *Proxy) Totals() Stats {
+	return Stats{
+		C2SBytes:   atomic.LoadUint64(&p.totals.C2SBytes),
+		C2SPackets: atomic.LoadUint64(&p.totals.C2SPackets),
+		S2CBytes:   atomic.LoadUint64(&p.totals.S2CBytes),
+		S2CPackets: atomic.LoadUint64(&p.totals.S2CPackets),
+	}
+}
+
+// Go routine which logs the totals, and the change over the last interval,
+// every interval
+func (p *Proxy) runStats(interval time.Duration) {
+	defer p.relays.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last Stats
+	var lastErrors uint64
+	var lastDrops [dropReasons]uint64
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t := p.Totals()
+		errs := atomic.LoadUint64(&p.errorCount)
+		drops := p.droppedTotals()
+		var dropped strings.Builder
+		for reason, name := range dropNames {
+			fmt.Fprintf(&dropped, " %s %d (+%d)", name, drops[reason], drops[reason]-lastDrops[reason])
+		}
+		p.Vlogf(LevelInfo, "Stats: %d connections; client to server %d packets %d bytes (+%d packets +%d bytes); server to client %d packets %d bytes (+%d packets +%d bytes); dropped%s; %d errors (+%d)\n",
+			atomic.LoadInt64(&p.connCount),
+			t.C2SPackets, t.C2SBytes, t.C2SPackets-last.C2SPackets, t.C2SBytes-last.C2SBytes,
+			t.S2CPackets, t.S2CBytes, t.S2CPackets-last.S2CPackets, t.S2CBytes-last.S2CBytes,
+			dropped.String(), errs, errs-lastErrors)
+		last, lastErrors, lastDrops = t, errs, drops
+	}
+}
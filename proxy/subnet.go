@@ -0,0 +1,59 @@
+package proxy
+
+import "net"
+
+// Subnet of the client at addr under the configured prefix lengths, empty
+// for clients without an IP address
+func (p *Proxy) subnetOf(addr net.Addr) string {
+	udpaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return ""
+	}
+	ip, bits := udpaddr.IP.To4(), p.config.SubnetPrefix
+	if ip == nil {
+		ip, bits = udpaddr.IP.To16(), p.config.SubnetPrefix6
+	}
+	if ip == nil {
+		return ""
+	}
+	mask := net.CIDRMask(bits, 8*len(ip))
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// Count a new connection from cliaddr against its subnet. Returns the
+// subnet, empty when not counted, and false if the subnet is already at
+// MaxPerSubnet. Called with the shard's dmutex held, like the connection
+// limit.
+func (p *Proxy) reserveSubnet(cliaddr net.Addr) (string, bool) {
+	max := p.config.MaxPerSubnet
+	if max == 0 {
+		return "", true
+	}
+	subnet := p.subnetOf(cliaddr)
+	if subnet == "" {
+		return "", true
+	}
+	p.snmutex.Lock()
+	defer p.snmutex.Unlock()
+	if p.subnets[subnet] >= max {
+		p.countDrop(dropPolicy)
+		p.Vlogs(LevelInfo, "subnet connection limit reached", Fields{Client: cliaddr.String()},
+			"Dropped packet from new client %s, %d connections already open from %s\n",
+			cliaddr.String(), max, subnet)
+		return "", false
+	}
+	p.subnets[subnet]++
+	return subnet, true
+}
+
+// Give back a connection counted by reserveSubnet
+func (p *Proxy) releaseSubnet(subnet string) {
+	if subnet == "" {
+		return
+	}
+	p.snmutex.Lock()
+	defer p.snmutex.Unlock()
+	if p.subnets[subnet]--; p.subnets[subnet] <= 0 {
+		delete(p.subnets, subnet)
+	}
+}
@@ -0,0 +1,242 @@
+package proxy
+
+// TCP bridging lets clients that can only reach the proxy over TCP talk to
+// a UDP server. Each accepted TCP connection gets its own Connection and
+// server socket, exactly like a UDP client, and lives until either side
+// closes it or it is reaped.
+//
+// Datagrams are framed on the TCP stream in both directions as a 2-byte
+// big-endian payload length followed by that many payload bytes:
+//
+//	+--------+--------+------------------+
+//	| len hi | len lo | payload (len)    |
+//	+--------+--------+------------------+
+//
+// A zero length is a valid, empty datagram. Frames longer than the buffer
+// size are read and discarded.
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Largest payload a frame can carry
+const maxFrame = 1<<16 - 1
+
+// Accept TCP clients on ln until the proxy is closed
+func (p *Proxy) runTCPListener(ln net.Listener) {
+	defer p.relays.Done()
+	for {
+		c, err := ln.Accept()
+		if err != nil && p.stopping() {
+			return
+		}
+		if p.checkreport(LevelError, err) {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		p.relays.Add(1)
+		go p.serveTCPClient(c)
+	}
+}
+
+// Bridge one TCP client to a server until either side goes away
+func (p *Proxy) serveTCPClient(c net.Conn) {
+	defer p.relays.Done()
+	tcpaddr, _ := c.RemoteAddr().(*net.TCPAddr)
+	if tcpaddr == nil || !p.current().allowedClient(tcpaddr.IP) {
+		p.countDrop(dropDenylist)
+		p.Vlogf(LevelVerbose, "Refused TCP client %s\n", c.RemoteAddr().String())
+		c.Close()
+		return
+	}
+	cliaddr := &net.UDPAddr{IP: tcpaddr.IP, Port: tcpaddr.Port, Zone: tcpaddr.Zone}
+
+	var header []byte
+	if p.config.ProxyProtocol {
+		header = proxyHeader(c.RemoteAddr(), c.LocalAddr(), true)
+	}
+	// As for a UDP client, the server is dialed only once a frame has
+	// passed every check, so frames that would be dropped cost no socket.
+	// Until then Close has no connection to close the stream with, so it
+	// is closed here if the proxy stops.
+	admitted := make(chan struct{})
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			c.Close()
+		case <-admitted:
+		}
+	}()
+	var conn *Connection
+	for conn == nil {
+		bufp := p.bufPool.Get().(*[]byte)
+		var ok bool
+		conn, ok = p.firstFrame(c, cliaddr, &header, *bufp)
+		p.bufPool.Put(bufp)
+		if !ok {
+			close(admitted)
+			c.Close()
+			return
+		}
+	}
+	close(admitted)
+	for {
+		bufp := p.bufPool.Get().(*[]byte)
+		ok := p.relayFrame(conn, &header, *bufp)
+		p.bufPool.Put(bufp)
+		if !ok {
+			break
+		}
+	}
+
+	// The client went away
+	p.dropConnection(conn)
+}
+
+// Read frames from the TCP client on c, at cliaddr, until one passes the
+// checks, then create its connection and relay the frame preceded by
+// *header, clearing it once sent. Returns nil while no frame has passed,
+// and false once the stream has ended or no connection could be made.
+func (p *Proxy) firstFrame(c net.Conn, cliaddr *net.UDPAddr, header *[]byte, buffer []byte) (*Connection, bool) {
+	saddr := cliaddr.String()
+	fields := Fields{Client: saddr, area: areaProxy}
+	data, bufp, ok := p.readClientFrame(c, fields, buffer)
+	defer p.clientCodec.release(bufp)
+	if data == nil {
+		return nil, ok
+	}
+	fields.Bytes = len(data)
+	// The same checks as a UDP client's first datagram, in the same order;
+	// the allow and deny lists were applied when the stream was accepted
+	if !p.validFirstPacket(data, fields) {
+		return nil, true
+	}
+	s := p.current()
+	if data = p.admitFromClient(s, data, fields); data == nil {
+		return nil, true
+	}
+	// Keyed apart from a UDP client that happens to use the same address
+	key := "tcp/" + saddr
+	shard := p.clientDict.shard(key)
+	shard.dlock()
+	shard.awaitDial(key)
+	if p.stopping() {
+		shard.dunlock()
+		return nil, false
+	}
+	conn := p.addConnection(shard, s, key, cliaddr)
+	if conn == nil {
+		shard.dunlock()
+		return nil, false
+	}
+	conn.ClientConn = c
+	shard.dunlock()
+	fields.Conn = conn.ID
+	p.logNewConnection(conn, "TCP ", fields)
+	p.connected(conn)
+	if p.ownSockets() {
+		p.readServer(conn)
+	}
+	// A new connection's bucket always has a token for its first frame
+	if !p.rateLimited(conn, fields) && p.sendFromClient(s, conn, *header, data, fields) {
+		*header = nil
+	}
+	return conn, true
+}
+
+// Read one frame from conn's TCP client and relay its payload to the
+// server, preceded by *header if any, clearing it once sent. Returns false
+// once the stream has ended.
+func (p *Proxy) relayFrame(conn *Connection, header *[]byte, buffer []byte) bool {
+	fields := Fields{Conn: conn.ID, Client: conn.ClientAddr.String(), area: areaProxy}
+	data, bufp, ok := p.readClientFrame(conn.ClientConn, fields, buffer)
+	defer p.clientCodec.release(bufp)
+	if data == nil {
+		return ok
+	}
+	fields.Bytes = len(data)
+	atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
+	if p.forwardToServer(p.current(), conn, *header, data, fields) {
+		*header = nil
+	}
+	return true
+}
+
+// Read one frame from a TCP client on c and decrypt and decompress its
+// payload. Returns a nil payload if the frame is dropped, with false if the
+// stream has ended, and the buffer to release once the payload is relayed.
+func (p *Proxy) readClientFrame(c net.Conn, fields Fields, buffer []byte) ([]byte, *[]byte, bool) {
+	saddr := fields.Client
+	data, err := readFrame(c, buffer)
+	if errors.Is(err, errFrameTooLarge) {
+		p.countDrop(dropOversize)
+		p.Vlogs(LevelInfo, "dropped oversized frame from client", fields,
+			"Dropped frame from TCP client %s larger than the %d byte buffer\n",
+			saddr, len(buffer))
+		return nil, nil, true
+	}
+	if err != nil {
+		if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+			p.checkreportFields(LevelError, fields, err)
+		}
+		return nil, nil, false
+	}
+	fields.Bytes = len(data)
+	if p.logs(LevelDebug, fields.area) {
+		p.Vlogs(LevelDebug, "read from client", fields, "Read %s from TCP client %s\n",
+			p.payload(data), saddr)
+	}
+	p.dumpPayload(fields, data)
+	if data = p.decryptFromClient(data, fields); data == nil {
+		return nil, nil, true
+	}
+	data, bufp := p.unpackFrom(p.clientCodec, "client", data, fields)
+	if data == nil || p.oversized(data, fields) {
+		return nil, bufp, true
+	}
+	return data, bufp, true
+}
+
+// Returned by readFrame when a frame does not fit the buffer. The frame
+// has been consumed, so the stream can still be read.
+var errFrameTooLarge = errors.New("frame larger than buffer")
+
+// Read one length-prefixed frame from r into buffer
+func readFrame(r io.Reader, buffer []byte) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > len(buffer) {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(n)); err != nil {
+			return nil, err
+		}
+		return nil, errFrameTooLarge
+	}
+	if _, err := io.ReadFull(r, buffer[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buffer[:n], nil
+}
+
+// Write data to w as one length-prefixed frame
+func writeFrame(w net.Conn, data []byte) error {
+	if len(data) > maxFrame {
+		return errors.New("datagram too large for a frame")
+	}
+	var hdr [2]byte
+	binary.BigEndian.PutUint16(hdr[:], uint16(len(data)))
+	bufs := net.Buffers{hdr[:], data}
+	_, err := bufs.WriteTo(w)
+	return err
+}
@@ -0,0 +1,76 @@
+package proxy_test
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/annlumia/udp-proxy/proxy"
+	"github.com/annlumia/udp-proxy/proxy/proxytest"
+)
+
+// Address of a loopback TCP port free to listen on
+func freeTCPPort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// Write data to c as one length-framed datagram
+func writeFrame(t *testing.T, c net.Conn, data []byte) {
+	t.Helper()
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	if _, err := c.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A bridged TCP client's first frame must pass RequirePrefix before its
+// server is dialed, as a UDP client's first datagram must
+func TestTCPFirstFrame(t *testing.T) {
+	addr := freeTCPPort(t)
+	env, err := proxytest.New(proxy.Config{
+		ListenTCP:     addr,
+		RequirePrefix: hex.EncodeToString([]byte("hi")),
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	writeFrame(t, c, []byte("no prefix"))
+	waitFor(t, "the frame to be refused", func() bool {
+		return env.Proxy.Dropped("policy") == 1
+	})
+	if n := len(env.Proxy.Connections()); n != 0 {
+		t.Fatalf("%d connections after a refused first frame, want 0", n)
+	}
+
+	writeFrame(t, c, []byte("hi there"))
+	c.SetReadDeadline(time.Now().Add(proxytest.DefaultTimeout))
+	reply := make([]byte, 2+len("hi there"))
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(reply[2:]); got != "hi there" {
+		t.Fatalf("got %q, want %q", got, "hi there")
+	}
+	if n := env.Servers[0].Received(); n != 1 {
+		t.Fatalf("server read %d datagrams, want 1", n)
+	}
+}
@@ -0,0 +1,16 @@
+package proxy
+
+// Hook for inspecting or rewriting payloads in flight. Each method gets a
+// datagram about to be relayed and returns the datagram to relay instead;
+// it may modify and return its argument. Returning nil drops the datagram.
+// Methods are called from many routines at once.
+type Transformer interface {
+	ClientToServer(data []byte) []byte
+	ServerToClient(data []byte) []byte
+}
+
+// Transformer used when Config.Transformer is nil. Relays payloads unchanged.
+type nopTransformer struct{}
+
+func (nopTransformer) ClientToServer(data []byte) []byte { return data }
+func (nopTransformer) ServerToClient(data []byte) []byte { return data }
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Most often the advice to raise BufferSize is repeated
+const truncWarnInterval = time.Minute
+
+// Warn, at most once per truncWarnInterval, that datagrams do not fit the
+// buffer. Each is also logged at LevelInfo, but the likely cause, such as
+// fragments reassembled by the kernel into a datagram larger than the
+// link MTU the buffer was sized for, is easy to miss among them. sure is
+// false where the platform cannot report truncation and a full buffer is
+// all there is to go on.
+func (p *Proxy) warnTruncated(sure bool) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&p.truncWarned)
+	if last != 0 && now-last < int64(truncWarnInterval) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&p.truncWarned, last, now) {
+		return
+	}
+	what := "are being dropped"
+	if !sure {
+		what = "may be arriving cut short"
+	}
+	p.Vlogf(LevelError, "Warning: datagrams larger than the %d byte buffer %s; raise buffer_size (-buffer-size), up to %d, to relay them whole. Repeated at most every %s\n",
+		p.config.BufferSize, what, MaxUDPPayload, truncWarnInterval)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package proxy
+
+// Truncation is not reported on this platform, so a datagram that fills
+// the buffer can only be flagged as possibly truncated
+const msgTrunc = 0
+
+const haveMsgTrunc = false
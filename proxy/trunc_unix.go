@@ -0,0 +1,13 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package proxy
+
+import "syscall"
+
+// Set in the flags returned by ReadMsgUDP when the kernel discarded part
+// of a datagram that did not fit the buffer
+const msgTrunc = syscall.MSG_TRUNC
+
+// Whether the platform reports truncation through msgTrunc
+const haveMsgTrunc = true
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Largest IPv4 TTL or IPv6 hop limit
+const MaxTTL = 255
+
+// Send datagrams on c with IPv4 TTL or IPv6 hop limit ttl. As with setDSCP,
+// a dual-stack socket gets both, the IPv4 one on a best effort basis.
+func setTTL(c *net.UDPConn, ttl int) error {
+	laddr := c.LocalAddr().(*net.UDPAddr)
+	if laddr.IP.To4() != nil {
+		return ipv4.NewConn(c).SetTTL(ttl)
+	}
+	if err := ipv6.NewConn(c).SetHopLimit(ttl); err != nil {
+		return err
+	}
+	if laddr.IP.IsUnspecified() {
+		ipv4.NewConn(c).SetTTL(ttl)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Prefix of the dictionary keys of unix clients, which are otherwise keyed
+// by the path their socket is bound to
+const unixKeyPrefix = "unix:"
+
+// Bind the unix datagram socket clients use instead of the proxy sockets.
+// A socket file left behind by an earlier run is replaced.
+func (p *Proxy) listenUnix(path string) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	uc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	if err := p.sizeBuffers(uc); err != nil {
+		uc.Close()
+		os.Remove(path)
+		return err
+	}
+	p.unixConn = uc
+	return nil
+}
+
+// Routine to handle inputs to the unix socket. Returns once the proxy is
+// closed.
+func (p *Proxy) runUnixProxy(uc *net.UnixConn) {
+	defer p.relays.Done()
+	for {
+		bufp := p.bufPool.Get().(*[]byte)
+		ok := p.relayFromUnixClient(uc, *bufp)
+		p.bufPool.Put(bufp)
+		if !ok {
+			return
+		}
+	}
+}
+
+// Read one datagram from a unix client and relay it to that client's
+// server. Returns false once the proxy is closed.
+func (p *Proxy) relayFromUnixClient(uc *net.UnixConn, buffer []byte) bool {
+	n, _, flags, cliaddr, err := uc.ReadMsgUnix(buffer, nil)
+	if errors.Is(err, net.ErrClosed) || err != nil && p.stopping() {
+		return false
+	}
+	if p.checkreport(LevelError, err) {
+		return p.readBackoff()
+	}
+	if cliaddr == nil || cliaddr.Name == "" {
+		// Replies have nowhere to go
+		p.Vlogs(LevelVerbose, "refused packet from unbound unix client", Fields{Bytes: n},
+			"Refused packet from unix client with an unbound socket\n")
+		return true
+	}
+	saddr := cliaddr.Name
+	fields := Fields{Client: saddr, Bytes: n, area: areaProxy}
+	if p.logs(LevelDebug, fields.area) {
+		p.Vlogs(LevelDebug, "read from client", fields, "Read %s from unix client %s\n",
+			p.payload(buffer[0:n]), saddr)
+	}
+	p.dumpPayload(fields, buffer[0:n])
+	if flags&msgTrunc != 0 {
+		p.warnTruncated(true)
+		p.countDrop(dropOversize)
+		p.Vlogs(LevelInfo, "dropped truncated datagram from client", fields,
+			"Dropped datagram from client %s larger than the %d byte buffer\n",
+			saddr, len(buffer))
+		return true
+	}
+	if !haveMsgTrunc && n == len(buffer) {
+		p.warnTruncated(false)
+		p.Vlogs(LevelInfo, "datagram from client may be truncated", fields,
+			"Warning: datagram from client %s filled the %d byte buffer and may be truncated\n",
+			saddr, n)
+	}
+	return p.relayDatagram(unixKeyPrefix+saddr, cliaddr, uc, uc.LocalAddr(), nil, buffer[0:n], fields)
+}
+
+// Number of unix server sockets opened, naming each one's local path
+var unixServerSeq uint64
+
+// Open a unix datagram socket to the ServerUnix server. It is bound to a
+// path of its own in the temporary directory, as the server could not
+// reply otherwise.
+func (p *Proxy) dialUnixServer() (*net.UnixConn, error) {
+	name := fmt.Sprintf("udp-proxy-%d-%d.sock", os.Getpid(), atomic.AddUint64(&unixServerSeq, 1))
+	laddr := &net.UnixAddr{Name: filepath.Join(os.TempDir(), name), Net: "unixgram"}
+	raddr := &net.UnixAddr{Name: p.config.ServerUnix, Net: "unixgram"}
+	uc, err := net.DialUnix("unixgram", laddr, raddr)
+	if err != nil {
+		// The bind may have succeeded before the connect failed
+		os.Remove(laddr.Name)
+		return nil, err
+	}
+	if err := p.sizeBuffers(uc); err != nil {
+		closeUnixServer(uc)
+		return nil, err
+	}
+	return uc, nil
+}
+
+// Close a socket opened by dialUnixServer and remove the path it is bound to
+func closeUnixServer(uc *net.UnixConn) {
+	path := uc.LocalAddr().String()
+	uc.Close()
+	os.Remove(path)
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// Most requests awaiting a reply from any one server in single upstream
+// socket mode. Past this the oldest are forgotten, so a silent server
+// cannot grow its queue without bound.
+const maxPending = 4096
+
+// Socket shared by every connection in single upstream socket mode. A reply
+// carries nothing to say which client it is for, so the replies from each
+// server are matched to the datagrams sent to it in the order they were sent.
+// A server that answers out of order, drops a request or sends unprompted
+// therefore has its replies delivered to the wrong client. With Collapse
+// the socket is bound to a fixed address, so the server sees every client
+// as that one peer.
+type upstream struct {
+	conn *net.UDPConn
+
+	// Connections waiting for a reply, oldest first, by server address.
+	// Guarded by qmutex.
+	pending map[string][]*Connection
+	qmutex  sync.Mutex
+}
+
+// Open the shared upstream socket on the Collapse address, or on an
+// ephemeral port of the SourceIP, if any
+func (p *Proxy) openUpstream() (*upstream, error) {
+	var laddr *net.UDPAddr
+	if p.sourceIP != nil {
+		laddr = &net.UDPAddr{IP: p.sourceIP}
+	}
+	if p.config.Collapse != "" {
+		var err error
+		laddr, err = net.ResolveUDPAddr(p.config.Network, p.config.Collapse)
+		if err != nil {
+			return nil, err
+		}
+	}
+	uudp, err := net.ListenUDP(p.config.Network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	if p.config.DSCPServer != 0 {
+		if err := setDSCP(uudp, p.config.DSCPServer); err != nil {
+			uudp.Close()
+			return nil, err
+		}
+	}
+	if p.config.TTLServer != 0 {
+		if err := setTTL(uudp, p.config.TTLServer); err != nil {
+			uudp.Close()
+			return nil, err
+		}
+	}
+	if p.config.DFServer {
+		if err := setDF(uudp); err != nil {
+			uudp.Close()
+			return nil, err
+		}
+	}
+	if err := p.sizeBuffers(uudp); err != nil {
+		uudp.Close()
+		return nil, err
+	}
+	return &upstream{conn: uudp, pending: make(map[string][]*Connection)}, nil
+}
+
+// Send data to conn's server and queue conn for the reply. The write is
+// done under qmutex so the queue order matches the order on the wire.
+func (u *upstream) send(conn *Connection, data []byte) error {
+	key := conn.ServerAddr.String()
+	u.qmutex.Lock()
+	defer u.qmutex.Unlock()
+	if _, err := u.conn.WriteToUDP(data, conn.ServerAddr); err != nil {
+		return err
+	}
+	q := append(u.pending[key], conn)
+	if len(q) > maxPending {
+		q = q[len(q)-maxPending:]
+	}
+	u.pending[key] = q
+	return nil
+}
+
+// Take the oldest connection waiting for a reply from server, nil if none
+func (u *upstream) pop(server string) *Connection {
+	u.qmutex.Lock()
+	defer u.qmutex.Unlock()
+	q := u.pending[server]
+	if len(q) == 0 {
+		return nil
+	}
+	conn := q[0]
+	q[0] = nil
+	if len(q) == 1 {
+		delete(u.pending, server)
+	} else {
+		u.pending[server] = q[1:]
+	}
+	return conn
+}
+
+// Routine which reads replies from the shared upstream socket and relays
+// each to the client whose request it answers
+func (p *Proxy) runUpstream() {
+	defer p.relays.Done()
+	for {
+		bufp := p.bufPool.Get().(*[]byte)
+		ok := p.relayFromUpstream(*bufp)
+		p.bufPool.Put(bufp)
+		if !ok {
+			return
+		}
+	}
+}
+
+// Read one reply from the shared upstream socket and relay it to the
+// client. Returns false once the socket has been closed.
+func (p *Proxy) relayFromUpstream(buffer []byte) bool {
+	n, _, flags, srvaddr, err := p.upstream.conn.ReadMsgUDP(buffer, nil)
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	if p.checkreport(LevelError, err) {
+		return p.readBackoff()
+	}
+	conn := p.upstream.pop(srvaddr.String())
+	if conn == nil || conn.isClosed() {
+		p.Vlogf(LevelVerbose, "Dropped unexpected datagram from server %s\n", srvaddr.String())
+		return true
+	}
+	p.relayToClient(conn, buffer, n, flags)
+	return true
+}
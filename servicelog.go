@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/annlumia/udp-proxy/proxy"
+	"github.com/kardianos/service"
+)
+
+// Proxy logger writing to the platform's service log, the Event Log on
+// Windows and syslog elsewhere. Only used when running as a service, where
+// stdout goes nowhere.
+type serviceLogger struct {
+	service.Logger
+}
+
+func (l serviceLogger) Printf(format string, v ...interface{}) {
+	l.Logf(proxy.LevelInfo, format, v...)
+}
+
+// Errors and warnings are filed apart from everything else
+func (l serviceLogger) Logf(level int, format string, v ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+	switch {
+	case level > proxy.LevelError:
+		l.Info(msg)
+	case strings.HasPrefix(msg, "Warning:"):
+		l.Warning(msg)
+	default:
+		l.Error(msg)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Dump the connections each time SIGUSR1 arrives
+func (p *program) dumpOnSignal() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	for range usr1 {
+		p.dumpConnections()
+	}
+}
+
+// Toggle draining each time SIGUSR2 arrives
+func (p *program) drainOnSignal() {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	for range usr2 {
+		p.setDraining(!p.proxy.Draining())
+	}
+}
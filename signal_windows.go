@@ -0,0 +1,7 @@
+package main
+
+// There is no SIGUSR1 on Windows; use the admin API instead
+func (p *program) dumpOnSignal() {}
+
+// There is no SIGUSR2 on Windows; use the admin API instead
+func (p *program) drainOnSignal() {}